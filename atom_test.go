@@ -16,6 +16,7 @@ import (
 	"github.com/kwonalbert/atom/server"
 	"github.com/kwonalbert/atom/trustee"
 
+	. "github.com/kwonalbert/atom/atomrpc"
 	. "github.com/kwonalbert/atom/common"
 	. "github.com/kwonalbert/atom/crypto"
 )
@@ -37,7 +38,7 @@ var faultTolerence = 1
 var numMsgs = 16
 var msgSize = 10 // in bytes
 var threshold = perGroup - faultTolerence
-var numClients = numGroups
+var numClients = numGroups - 1
 
 var cpuprofile = "cpuprofile"
 
@@ -77,7 +78,7 @@ func TestNIZKMixing(t *testing.T) {
 	results := make(chan [][]byte, len(clients))
 	for c := range clients {
 		go func(c int) {
-			clients[c].Submit(c, 0, plaintextss[c])
+			clients[c].Submit(0, plaintextss[c])
 			res, err := clients[c].DownloadMsgs(0)
 			if err != nil {
 				t.Error(err)
@@ -124,11 +125,15 @@ func TestTrapMixing(t *testing.T) {
 	results := make(chan [][]byte, len(clients))
 	for c := range clients {
 		go func(c int) {
-			clients[c].Submit(c, 0, plaintextss[c])
+			clients[c].Submit(0, plaintextss[c])
 			res, err := clients[c].DownloadMsgs(0)
 			if err != nil {
 				t.Error(err)
 			}
+			err = clients[c].VerifyTraps(0)
+			if err != nil {
+				t.Error(err)
+			}
 			results <- res
 		}(c)
 	}
@@ -165,30 +170,44 @@ func setup(testMode int) (*directory.Directory, []*trustee.Trustee, []*server.Se
 
 	wg := new(sync.WaitGroup)
 
-	dir, err := directory.NewDirectory(0, dirPort, testMode, testNet,
-		numServers, numGroups, perGroup, numTrustees_,
-		numMsgs, msgSize, threshold,
-		numClients)
+	dirCert, _ := AtomTLSConfig()
+	config := &directory.Config{
+		SystemParameter: SystemParameter{
+			Mode:        testMode,
+			NetType:     testNet,
+			NumServers:  numServers,
+			NumGroups:   numGroups,
+			PerGroup:    perGroup,
+			NumTrustees: numTrustees_,
+			NumClients:  numClients,
+			NumMsgs:     numMsgs,
+			MsgSize:     msgSize,
+			Threshold:   threshold,
+		},
+	}
+	dir, err := directory.NewDirectory(0, dirPort, "", config, "", dirCert)
 	if err != nil {
 		log.Fatal("Directory creation err:", err)
 	}
 
-	db, err := db.NewDB(dbPort)
+	dbCert, _ := AtomTLSConfig()
+	db, err := db.NewDB(dbPort, dbCert)
 	if err != nil {
 		log.Fatal("DB creation err:", err)
 	}
 
 	trustees := make([]*trustee.Trustee, numTrustees_)
 	servers := make([]*server.Server, numServers)
-	clients := make([]*client.Client, numGroups)
+	clients := make([]*client.Client, numClients)
 
 	dirAddrs := []string{fmt.Sprintf(addr, dirPort)}
+	dirCerts := [][]byte{dirCert.Certificate[0]}
 	dbAddr := fmt.Sprintf(addr, dbPort)
 
 	// start the servers
 	for i := range servers {
 		servers[i], err = server.NewServer(fmt.Sprintf(addr, port+i), i,
-			"", dirAddrs, dbAddr)
+			"", dirAddrs, dirCerts, dbAddr, dbCert.Certificate[0])
 		if err != nil {
 			log.Fatal("Server creation err:", err)
 		}
@@ -196,7 +215,7 @@ func setup(testMode int) (*directory.Directory, []*trustee.Trustee, []*server.Se
 
 	for i := range trustees {
 		trustees[i], err = trustee.NewTrustee(fmt.Sprintf(addr, trusteePort+i), i,
-			"", dirAddrs)
+			"", dirAddrs, dirCerts)
 		if err != nil {
 			log.Fatal("Trustee creation err:", err)
 		}
@@ -217,15 +236,23 @@ func setup(testMode int) (*directory.Directory, []*trustee.Trustee, []*server.Se
 		go func(i int) {
 			defer wg.Done()
 			trustees[i].Setup()
-			trustees[i].RegisterRound()
+			err := trustees[i].RegisterRound()
+			if err != nil {
+				log.Fatal("Round key err:", err)
+			}
 		}(i)
 	}
 
 	wg.Wait()
 
 	for i := range clients {
-		clients[i], _ = client.NewClient(i, dirAddrs, dbAddr)
+		clients[i], _ = client.NewClient(i, "", dirAddrs, dirCerts,
+			dbAddr, dbCert.Certificate[0])
 		clients[i].Setup()
+		// mix both entry policies
+		if i%2 == 1 {
+			clients[i].SetEntryPolicy(client.RANDOM_ENTRY)
+		}
 	}
 
 	return dir, trustees, servers, clients, db
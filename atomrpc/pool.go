@@ -0,0 +1,126 @@
+package atomrpc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// ConnPool keeps long-lived TLS connections to other nodes so that
+// repeated calls do not pay for a handshake every time. It only
+// connects to addresses with a pinned certificate. It is safe for
+// concurrent use.
+type ConnPool struct {
+	tlsConfig *tls.Config
+
+	lock  *sync.Mutex
+	conns map[string]*rpc.Client
+	pins  map[string][]byte
+}
+
+func NewConnPool(tlsConfig *tls.Config) *ConnPool {
+	return &ConnPool{
+		tlsConfig: tlsConfig,
+
+		lock:  new(sync.Mutex),
+		conns: make(map[string]*rpc.Client),
+		pins:  make(map[string][]byte),
+	}
+}
+
+// Pin the certificate the node at addr has to present. A connection
+// made under a different pin is closed.
+func (p *ConnPool) Pin(addr string, cert []byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if old, ok := p.pins[addr]; ok && !bytes.Equal(old, cert) {
+		if client, ok := p.conns[addr]; ok {
+			delete(p.conns, addr)
+			client.Close()
+		}
+	}
+	p.pins[addr] = cert
+}
+
+// get returns the cached connection to addr, dialing a new one if
+// there is none yet. The dial happens without the lock, so a slow node
+// doesn't hold up calls to the others.
+func (p *ConnPool) get(addr string) (*rpc.Client, error) {
+	p.lock.Lock()
+	client, ok := p.conns[addr]
+	pin := p.pins[addr]
+	p.lock.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	conn, err := DialPinned(addr, p.tlsConfig, pin)
+	if err != nil {
+		return nil, err
+	}
+	client = rpc.NewClient(conn)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// someone else connected meanwhile, or the pin changed under us
+	if cur, ok := p.conns[addr]; ok {
+		client.Close()
+		return cur, nil
+	}
+	if !bytes.Equal(p.pins[addr], pin) {
+		client.Close()
+		return nil, errors.New("Certificate of " + addr + " changed while connecting")
+	}
+	p.conns[addr] = client
+	return client, nil
+}
+
+// drop closes and forgets the connection to addr, if it is still client
+func (p *ConnPool) drop(addr string, client *rpc.Client) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if cur, ok := p.conns[addr]; ok && cur == client {
+		delete(p.conns, addr)
+		client.Close()
+	}
+}
+
+// Call invokes method on the node at addr with timeout. A connection
+// that was found dead before the request went out is replaced and
+// the call retried once; any other broken connection, including one
+// that timed out, is dropped so that the next call reconnects.
+func (p *ConnPool) Call(addr, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	for retry := 0; ; retry++ {
+		client, err := p.get(addr)
+		if err != nil {
+			return err
+		}
+
+		err = AtomRPC(client, method, args, reply, timeout)
+		if err == nil {
+			return nil
+		}
+
+		if _, ok := err.(rpc.ServerError); ok {
+			// the connection itself is fine
+			return err
+		}
+
+		p.drop(addr, client)
+		if err != rpc.ErrShutdown || retry > 0 {
+			return err
+		}
+	}
+}
+
+func (p *ConnPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for addr, client := range p.conns {
+		client.Close()
+		delete(p.conns, addr)
+	}
+}
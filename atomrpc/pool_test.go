@@ -0,0 +1,202 @@
+package atomrpc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+var poolAddr = "127.0.0.1:%d"
+var poolPort = 11001
+var poolTimeout = 5 * time.Second
+
+type Echo struct{}
+
+func (e *Echo) Echo(args *int, reply *int) error {
+	*reply = *args
+	return nil
+}
+
+func (e *Echo) Slow(args *int, reply *int) error {
+	time.Sleep(time.Second)
+	*reply = *args
+	return nil
+}
+
+// listen returns the certificate to pin, and a function to stop
+func listen(port int) ([]byte, func(), error) {
+	cert, tlsConfig := AtomTLSConfig()
+	l, err := tls.Listen("tcp", fmt.Sprintf(poolAddr, port), tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(&Echo{})
+	go rpcServer.Accept(l)
+	return cert.Certificate[0], func() { l.Close() }, nil
+}
+
+func TestPoolReuse(t *testing.T) {
+	cert, stop, err := listen(poolPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	_, tlsConfig := AtomTLSConfig()
+	pool := NewConnPool(tlsConfig)
+	defer pool.Close()
+
+	addr := fmt.Sprintf(poolAddr, poolPort)
+	pool.Pin(addr, cert)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			err := pool.Call(addr, "Echo.Echo", &i, &reply, poolTimeout)
+			if err != nil {
+				t.Error(err)
+			} else if reply != i {
+				t.Error("Mismatched reply")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(pool.conns) != 1 {
+		t.Error("Expected a single pooled connection, got", len(pool.conns))
+	}
+}
+
+func TestPoolReconnect(t *testing.T) {
+	cert, stop, err := listen(poolPort + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	_, tlsConfig := AtomTLSConfig()
+	pool := NewConnPool(tlsConfig)
+	defer pool.Close()
+
+	addr := fmt.Sprintf(poolAddr, poolPort+1)
+	pool.Pin(addr, cert)
+	args, reply := 1, 0
+	err = pool.Call(addr, "Echo.Echo", &args, &reply, poolTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// kill the cached connection underneath the pool
+	old := pool.conns[addr]
+	old.Close()
+
+	err = pool.Call(addr, "Echo.Echo", &args, &reply, poolTimeout)
+	if err != nil {
+		t.Error("Pool did not reconnect:", err)
+	}
+	if pool.conns[addr] == old {
+		t.Error("Pool kept the dead connection")
+	}
+}
+
+func TestPoolTimeout(t *testing.T) {
+	cert, stop, err := listen(poolPort + 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	_, tlsConfig := AtomTLSConfig()
+	pool := NewConnPool(tlsConfig)
+	defer pool.Close()
+
+	addr := fmt.Sprintf(poolAddr, poolPort+4)
+	pool.Pin(addr, cert)
+	args, reply := 1, 0
+	err = pool.Call(addr, "Echo.Slow", &args, &reply, 10*time.Millisecond)
+	if err == nil {
+		t.Fatal("Slow call did not time out")
+	}
+	if _, ok := pool.conns[addr]; ok {
+		t.Error("Pool kept the connection that timed out")
+	}
+
+	err = pool.Call(addr, "Echo.Echo", &args, &reply, poolTimeout)
+	if err != nil {
+		t.Error("Pool did not reconnect:", err)
+	}
+}
+
+func TestPoolPin(t *testing.T) {
+	_, stop, err := listen(poolPort + 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	_, tlsConfig := AtomTLSConfig()
+	pool := NewConnPool(tlsConfig)
+	defer pool.Close()
+
+	addr := fmt.Sprintf(poolAddr, poolPort+2)
+	args, reply := 1, 0
+	err = pool.Call(addr, "Echo.Echo", &args, &reply, poolTimeout)
+	if err == nil {
+		t.Error("Connected without a pinned certificate")
+	}
+
+	other, _ := AtomTLSConfig()
+	pool.Pin(addr, other.Certificate[0])
+	err = pool.Call(addr, "Echo.Echo", &args, &reply, poolTimeout)
+	if err == nil {
+		t.Error("Connected to a peer with the wrong certificate")
+	}
+}
+
+// Caller echoes back the certificate its caller presented
+type Caller struct {
+	cert []byte
+}
+
+func (c *Caller) Cert(_ *int, reply *[]byte) error {
+	*reply = c.cert
+	return nil
+}
+
+func TestServeWithCert(t *testing.T) {
+	cert, tlsConfig := AtomTLSConfig()
+	l, err := tls.Listen("tcp", fmt.Sprintf(poolAddr, poolPort+3), PeerConfig(tlsConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ServeWithCert(l, func(cert []byte) *rpc.Server {
+		rpcServer := rpc.NewServer()
+		rpcServer.Register(&Caller{cert})
+		return rpcServer
+	})
+
+	callerCert, callerConfig := AtomTLSConfig()
+	conn, err := DialPinned(fmt.Sprintf(poolAddr, poolPort+3), callerConfig,
+		cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	var seen []byte
+	err = client.Call("Caller.Cert", 0, &seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(seen, callerCert.Certificate[0]) {
+		t.Error("Handler did not get the caller's certificate")
+	}
+}
@@ -1,6 +1,12 @@
 package atomrpc
 
-import . "github.com/kwonalbert/atom/crypto"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	. "github.com/kwonalbert/atom/crypto"
+)
 
 type DealArgs struct {
 	Uid  int // the unique id of group
@@ -19,6 +25,70 @@ type ResponseArgs struct {
 type ResponseReply struct {
 }
 
+// deals and responses of the trustees' key generation for a round
+// deals and responses are signed by the trustee's long-term key
+type RoundDealArgs struct {
+	Round int
+	Idx   int // the dealing trustee
+	Deal  *ThresholdDeal
+	Sig   *Signature
+}
+
+type RoundResponseArgs struct {
+	Round int
+	Idx   int // the responding trustee
+	Resp  *ThresholdResponse
+	Sig   *Signature
+}
+
+func roundMessage(round, idx int, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(round))
+	binary.Write(buf, binary.LittleEndian, uint32(idx))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func (a *RoundDealArgs) Sign(priv *PrivateKey) error {
+	data, err := a.Deal.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	a.Sig = Sign(priv, roundMessage(a.Round, a.Idx, data))
+	return nil
+}
+
+func (a *RoundDealArgs) Verify(pub *PublicKey) error {
+	if a.Deal == nil || a.Deal.D == nil || a.Sig == nil {
+		return errors.New("Incomplete deal")
+	}
+	data, err := a.Deal.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return Verify(pub, roundMessage(a.Round, a.Idx, data), a.Sig)
+}
+
+func (a *RoundResponseArgs) Sign(priv *PrivateKey) error {
+	data, err := a.Resp.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	a.Sig = Sign(priv, roundMessage(a.Round, a.Idx, data))
+	return nil
+}
+
+func (a *RoundResponseArgs) Verify(pub *PublicKey) error {
+	if a.Resp == nil || a.Resp.R == nil || a.Sig == nil {
+		return errors.New("Incomplete response")
+	}
+	data, err := a.Resp.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return Verify(pub, roundMessage(a.Round, a.Idx, data), a.Sig)
+}
+
 // basic required info for most rpc calls
 type ArgInfo struct {
 	Round int
@@ -32,15 +102,42 @@ type SubmitArgs struct {
 	Id          int // client id
 	Ciphertexts []Ciphertext
 	EncProofs   []EncProof
+	Token       *Token // only used when submissions are authenticated
 	ArgInfo
 }
 
+// An anonymous credential, blindly signed by a directory, that
+// authorizes a single msg (and its trap) to one entry group in one
+// round
+type Token struct {
+	Dir    int // index of the issuing directory
+	Serial []byte
+	Sig    *Signature
+}
+
+// The msg signed for a token; binds the serial to a round and gid
+func TokenMessage(round, gid int, serial []byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(round))
+	binary.Write(buf, binary.LittleEndian, uint32(gid))
+	buf.Write(serial)
+	return buf.Bytes()
+}
+
+// The only directory that issues tokens for round; if any of them
+// could, every client would get a quota from each
+func TokenIssuer(round, numDirs int) int {
+	return round % numDirs
+}
+
 type SubmitReply struct {
 }
 
 type CommitArgs struct {
-	Id    int // client id
-	Comms []Commitment
+	Id      int // client id
+	NumMsgs int // msgs the client submits to the group this round
+	Comms   []Commitment
+	Tokens  []*Token // one for every msg, when submissions are authenticated
 	ArgInfo
 }
 
@@ -112,6 +209,7 @@ type FinalizeReply struct {
 
 type ReportArgs struct {
 	Round        int
+	Epoch        int // the layout the server reports as a member of
 	Sid          int
 	Uid          int
 	CorrectHash  bool
@@ -119,10 +217,208 @@ type ReportArgs struct {
 	NoDups       bool
 	NumTraps     int
 	NumMsgs      int
+	Comms        []Commitment // commitments of the traps recovered
+	Rs           []*Point     // R of each inner ciphertext to decrypt
+
+	Sig *Signature // by the server's long-term key
+}
+
+func (r *ReportArgs) message() []byte {
+	buf := new(bytes.Buffer)
+	for _, v := range []int{r.Round, r.Epoch, r.Sid, r.Uid, r.NumTraps, r.NumMsgs} {
+		binary.Write(buf, binary.LittleEndian, uint32(v))
+	}
+	binary.Write(buf, binary.LittleEndian, []bool{r.CorrectHash, r.CorrectTraps, r.NoDups})
+	binary.Write(buf, binary.LittleEndian, uint32(len(r.Comms)))
+	for _, c := range r.Comms {
+		buf.Write(c[:])
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(r.Rs)))
+	for _, R := range r.Rs {
+		b, _ := R.MarshalBinary()
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+func (r *ReportArgs) Sign(priv *PrivateKey) {
+	r.Sig = Sign(priv, r.message())
+}
+
+func (r *ReportArgs) Verify(pub *PublicKey) error {
+	return Verify(pub, r.message(), r.Sig)
+}
+
+// An entry group member's commitment to the trap commitments it got
+// from the clients, sent before the round is mixed
+type EntryReport struct {
+	Round int
+	Epoch int
+	Sid   int
+	Uid   int
+	Traps Commitment // CommitSet of the trap commitments
+
+	// one trap comes with every real message, so an honest group has
+	// twice as many ciphertexts as traps
+	NumTraps int
+	NumMsgs  int // ciphertexts, messages and traps
+
+	Sig *Signature // by the server's long-term key
+}
+
+func (r *EntryReport) message() []byte {
+	buf := new(bytes.Buffer)
+	for _, v := range []int{r.Round, r.Epoch, r.Sid, r.Uid, r.NumTraps, r.NumMsgs} {
+		binary.Write(buf, binary.LittleEndian, uint32(v))
+	}
+	buf.Write(r.Traps[:])
+	return buf.Bytes()
+}
+
+func (r *EntryReport) Sign(priv *PrivateKey) {
+	r.Sig = Sign(priv, r.message())
+}
+
+func (r *EntryReport) Verify(pub *PublicKey) error {
+	return Verify(pub, r.message(), r.Sig)
+}
+
+// The traps an exit group recovered, sent before they go back to the
+// entry groups
+type ExitReport struct {
+	Round int
+	Epoch int
+	Sid   int
+	Uid   int
+	Traps []Trap
+
+	// R of each real message sent to each entry group, by gid; the
+	// trustees only decrypt those
+	Rs [][]*Point
+
+	Sig *Signature // by the server's long-term key
+}
+
+func (r *ExitReport) message() []byte {
+	buf := new(bytes.Buffer)
+	for _, v := range []int{r.Round, r.Epoch, r.Sid, r.Uid, len(r.Traps)} {
+		binary.Write(buf, binary.LittleEndian, uint32(v))
+	}
+	for _, trap := range r.Traps {
+		binary.Write(buf, binary.LittleEndian, uint32(trap.Gid))
+		binary.Write(buf, binary.LittleEndian, uint32(len(trap.Nonce)))
+		buf.Write(trap.Nonce)
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(r.Rs)))
+	for _, Rs := range r.Rs {
+		binary.Write(buf, binary.LittleEndian, uint32(len(Rs)))
+		for _, R := range Rs {
+			b, _ := R.MarshalBinary()
+			buf.Write(b)
+		}
+	}
+	return buf.Bytes()
+}
+
+func (r *ExitReport) Sign(priv *PrivateKey) {
+	r.Sig = Sign(priv, r.message())
+}
+
+func (r *ExitReport) Verify(pub *PublicKey) error {
+	return Verify(pub, r.message(), r.Sig)
+}
+
+const (
+	UNDECIDED = 0
+	RELEASE   = 1 // the reports check out, and the round is opened
+	WITHHOLD  = 2
+)
+
+// what the members of a group reported
+type GroupReport struct {
+	Uid      int
+	Sids     []int // the members that reported
+	NumTraps int
+	NumMsgs  int
+}
+
+// the members of a group whose reports were not in by the deadline
+type MissingReports struct {
+	Uid  int
+	Sids []int
+}
+
+// a problem the trap audit found with one group
+type Finding struct {
+	Uid    int // -1 for a gid that has no entry group
+	Gid    int
+	Reason string
+}
+
+// A trustee's decision on a round, and why; every report of the round
+// is answered with the same verdict
+type Verdict struct {
+	Round    int
+	Trustee  int
+	Decision int
+	Reason   string // the first check that failed, if any
+	Groups   []GroupReport
+	Missing  []MissingReports // only if the deadline passed
+	Findings []Finding        // every group that failed the trap audit
+
+	Sig *Signature // by the trustee's long-term key
+}
+
+func (v *Verdict) message() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(v.Round))
+	binary.Write(buf, binary.LittleEndian, uint32(v.Trustee))
+	binary.Write(buf, binary.LittleEndian, uint32(v.Decision))
+	binary.Write(buf, binary.LittleEndian, uint32(len(v.Reason)))
+	buf.Write([]byte(v.Reason))
+	binary.Write(buf, binary.LittleEndian, uint32(len(v.Groups)))
+	for _, g := range v.Groups {
+		binary.Write(buf, binary.LittleEndian, uint32(g.Uid))
+		binary.Write(buf, binary.LittleEndian, uint32(g.NumTraps))
+		binary.Write(buf, binary.LittleEndian, uint32(g.NumMsgs))
+		binary.Write(buf, binary.LittleEndian, uint32(len(g.Sids)))
+		for _, sid := range g.Sids {
+			binary.Write(buf, binary.LittleEndian, uint32(sid))
+		}
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(v.Missing)))
+	for _, m := range v.Missing {
+		binary.Write(buf, binary.LittleEndian, uint32(m.Uid))
+		binary.Write(buf, binary.LittleEndian, uint32(len(m.Sids)))
+		for _, sid := range m.Sids {
+			binary.Write(buf, binary.LittleEndian, uint32(sid))
+		}
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(v.Findings)))
+	for _, f := range v.Findings {
+		binary.Write(buf, binary.LittleEndian, int32(f.Uid))
+		binary.Write(buf, binary.LittleEndian, uint32(f.Gid))
+		binary.Write(buf, binary.LittleEndian, uint32(len(f.Reason)))
+		buf.Write([]byte(f.Reason))
+	}
+	return buf.Bytes()
+}
+
+func (v *Verdict) Sign(priv *PrivateKey) {
+	v.Sig = Sign(priv, v.message())
+}
+
+func (v *Verdict) Verify(pub *PublicKey) error {
+	return Verify(pub, v.message(), v.Sig)
 }
 
+// The trustee's verdict, and if it released the round, its partial
+// decryption x_i*R of each of the report's Rs, with a proof that it
+// used its share x_i of the round key
 type ReportReply struct {
-	Priv *PrivateKey
+	Verdict  *Verdict
+	Partials []*Point
+	Proofs   []DLEQProof
 }
 
 type DBArgs struct {
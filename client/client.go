@@ -5,8 +5,12 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
+	"math/big"
 	"net/rpc"
+	"sync"
 	"time"
 
 	. "github.com/kwonalbert/atom/atomrpc"
@@ -16,36 +20,79 @@ import (
 	"github.com/kwonalbert/atom/directory"
 )
 
+// entry group selection policies
+const (
+	// spread msgs evenly over all groups, starting from a uniformly
+	// random group, so every entry group gets the same share
+	SPLIT_ENTRY = 0
+	// pick an independent, uniformly random group for every msg;
+	// per-group counts are then only balanced in expectation
+	RANDOM_ENTRY = 1
+)
+
 type Client struct {
-	id int
+	id     int
+	policy int // entry group selection policy
 
 	params  SystemParameter
 	network [][]*Group
+	epoch   int // epoch of the network
 
 	dirAddrs   []string
 	dirServers []*rpc.Client
+	dirKeys    []*PublicKey
+	tokenKeys  []*PublicKey // the directories' token issuing keys
+	quorum     int          // # of directories that must agree
 	dbServer   *rpc.Client
 	directory  *directory.Directory
 	publicKeys []*PublicKey
 
+	keyPair *KeyPair // long-term key, used to get submission tokens
+
 	start time.Time
 
 	tlsConfig *tls.Config
+	pool      *ConnPool // connections to entry group servers
+
+	traps map[int][]Trap // round to traps sent that round
+	tlock *sync.Mutex
+
+	replyKeys map[int][]*KeyPair // round to one-time keys for replies
+	rlock     *sync.Mutex
 }
 
-func NewClient(id int, dirAddrs []string, dbAddr string) (*Client, error) {
+func NewClient(id int, keyFile string, dirAddrs []string, dirCerts [][]byte,
+	dbAddr string, dbCert []byte) (*Client, error) {
 	_, tlsConfig := AtomTLSConfig()
 
+	// read key pair from a file, or generate a new key pair
+	var keyPair *KeyPair
+	if keyFile == "" {
+		keyPair = GenKey()
+	} else {
+		clientKeys, err := ReadKeys(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if id < 0 || id >= len(clientKeys) {
+			return nil, errors.New("No key for this client")
+		}
+		keyPair = LoadKey(clientKeys[id])
+	}
+
+	if len(dirCerts) != len(dirAddrs) {
+		return nil, errors.New("Need a certificate for every directory")
+	}
 	dirServers := make([]*rpc.Client, len(dirAddrs))
 	for d, dirAddr := range dirAddrs {
-		conn, err := tls.Dial("tcp", dirAddr, tlsConfig)
+		conn, err := DialPinned(dirAddr, tlsConfig, dirCerts[d])
 		if err != nil {
 			return nil, err
 		}
 		dirServers[d] = rpc.NewClient(conn)
 	}
 
-	conn, err := tls.Dial("tcp", dbAddr, tlsConfig)
+	conn, err := DialPinned(dbAddr, tlsConfig, dbCert)
 	if err != nil {
 		return nil, err
 	}
@@ -53,55 +100,164 @@ func NewClient(id int, dirAddrs []string, dbAddr string) (*Client, error) {
 
 	c := &Client{
 		id:         id,
+		policy:     SPLIT_ENTRY,
 		dirAddrs:   dirAddrs,
 		dirServers: dirServers,
+		quorum:     len(dirAddrs),
 		dbServer:   dbServer,
 
+		keyPair: keyPair,
+
 		tlsConfig: tlsConfig,
+		pool:      NewConnPool(tlsConfig),
+
+		traps: make(map[int][]Trap),
+		tlock: new(sync.Mutex),
+
+		replyKeys: make(map[int][]*KeyPair),
+		rlock:     new(sync.Mutex),
 	}
 
 	return c, nil
 }
 
 // primary function used by clients
-func (c *Client) Submit(gid, round int, plaintexts [][]byte) {
+func (c *Client) Submit(round int, plaintexts [][]byte) {
+	c.refresh()
 	msgs := c.generateMessages(round, plaintexts)
 
-	// commit the traps first
-	if c.params.Mode == TRAP_MODE {
-		traps := c.generateTraps(c.id)
-		trapMsgs := c.generateTrapMsgs(traps, len(msgs[0]))
-		msgs = append(msgs, trapMsgs...)
+	gids := entryGroups(len(msgs), c.params.NumGroups, c.policy)
+	batches := make(map[int][]Message)
+	for m := range msgs {
+		batches[gids[m]] = append(batches[gids[m]], msgs[m])
+	}
+	tokens := make(map[int][]*Token)
+	for m, token := range c.getTokens(round, gids) {
+		tokens[gids[m]] = append(tokens[gids[m]], token)
+	}
 
-		if c.id == 0 {
-			log.Println("Committing traps")
-		}
-		cargs := c.generateCommitArgs(c.id, traps)
-		c.commit(c.id, cargs)
+	// every entry group hears how many msgs this client sends it,
+	// even if none, so it knows when it has them all
+	if c.id == 0 {
+		log.Println("Committing msgs")
 	}
+	for gid := 0; gid < c.params.NumGroups; gid++ {
+		batch := batches[gid]
+		var traps []Trap
+		var trapMsgs []Message
+		// commit the traps first
+		if c.params.Mode == TRAP_MODE && len(batch) > 0 {
+			traps = c.generateTraps(gid, len(batch))
+			trapMsgs = c.generateTrapMsgs(traps, len(batch[0]))
+
+			c.tlock.Lock()
+			c.traps[round] = append(c.traps[round], traps...)
+			c.tlock.Unlock()
+		}
+		cargs := c.generateCommitArgs(gid, round, len(batch), traps)
+		cargs.Tokens = tokens[gid]
+		c.commit(gid, cargs)
+		if len(batch) == 0 {
+			continue
+		}
 
-	submitArgs := c.generateSubmitArgs(gid, round, msgs)
-	c.submit(gid, submitArgs)
+		if !c.params.Auth {
+			submitArgs := c.generateSubmitArgs(gid, round, append(batch, trapMsgs...))
+			c.submit(gid, submitArgs)
+			continue
+		}
+		// a token only covers one msg and its trap, in random order
+		for m := range batch {
+			sub := []Message{batch[m]}
+			if trapMsgs != nil {
+				sub = append(sub, trapMsgs[m])
+				if randInt(2) == 1 {
+					sub[0], sub[1] = sub[1], sub[0]
+				}
+			}
+			submitArgs := c.generateSubmitArgs(gid, round, sub)
+			submitArgs.Token = tokens[gid][m]
+			c.submit(gid, submitArgs)
+		}
+	}
 	c.start = time.Now()
 }
 
+// WaitRound blocks until a quorum of the directories announce the next
+// round after round, and returns it; -1 waits for the first round. The
+// round's key is kept for Submit.
+func (c *Client) WaitRound(round int) (*directory.RoundInfo, error) {
+	info, err := directory.WaitRound(c.dirServers, c.quorum, round)
+	if err != nil {
+		return nil, err
+	}
+	if info.Key != "" {
+		if c.directory.RoundKeys == nil {
+			c.directory.RoundKeys = make(map[int]string)
+		}
+		c.directory.RoundKeys[info.Round] = info.Key
+	}
+	return info, nil
+}
+
+// Set how many directories have to agree on a snapshot;
+// defaults to all of them
+func (c *Client) SetQuorum(quorum int) {
+	c.quorum = quorum
+}
+
+// Change how entry groups are chosen for future submissions
+func (c *Client) SetEntryPolicy(policy int) {
+	c.policy = policy
+}
+
 func (c *Client) Setup() {
+	c.registerClient()
+
+	c.dirKeys = directory.GetKeys(c.dirServers)
+	c.setupGroups()
+}
+
+// set up the groups again if the directories moved to a new epoch
+func (c *Client) refresh() {
+	var epoch int
+	err := c.dirServers[0].Call("DirectoryRPC.Epoch", 0, &epoch)
+	if err != nil {
+		log.Fatal("Epoch err:", err)
+	}
+	if epoch != c.epoch {
+		c.setupGroups()
+	}
+}
+
+func (c *Client) setupGroups() {
 	var keys [][]*PublicKey
-	c.directory, c.params, c.publicKeys, keys = directory.GetGroupKeys(c.dirServers)
+	var err error
+	c.directory, c.params, c.publicKeys, keys, err = directory.GetGroupKeys(c.dirServers,
+		c.dirKeys, c.quorum)
+	if err != nil {
+		log.Fatal("Directory err:", err)
+	}
 
-	var seed [SEED_LEN]byte
-	for _, dirServer := range c.dirServers {
-		var val [SEED_LEN]byte
-		err := dirServer.Call("DirectoryRPC.Randomness", 0, &val)
-		if err != nil {
-			log.Fatal("Randomness err:", err)
-		}
-		Xor(val[:], seed[:])
+	seed, err := directory.GetRandomness(c.dirServers, c.dirKeys,
+		c.directory.Epoch)
+	if err != nil {
+		log.Fatal("Randomness err:", err)
 	}
 	network := GenerateGroups(seed, c.params.NetType, c.params.NumServers,
 		c.params.NumGroups, c.params.PerGroup,
 		c.params.NumLevels, c.publicKeys)
 	c.network = network
+	c.epoch = c.directory.Epoch
+
+	for id, addr := range c.directory.Servers {
+		if addr != "" {
+			c.pool.Pin(addr, Leaf(c.directory.Certificates[id]))
+		}
+	}
+	for t, addr := range c.directory.Trustees {
+		c.pool.Pin(addr, Leaf(c.directory.TrusteeCerts[t]))
+	}
 
 	for level := range keys {
 		for gid := range keys[level] {
@@ -111,6 +267,70 @@ func (c *Client) Setup() {
 
 }
 
+func (c *Client) registerClient() {
+	for _, dirServer := range c.dirServers {
+		reg := &directory.Registration{
+			Id:  c.id,
+			Key: DumpPubKey(c.keyPair.Pub),
+		}
+		reg.Sign(c.keyPair.Priv)
+		err := dirServer.Call("DirectoryRPC.RegisterClient", reg, nil)
+		if err != nil {
+			log.Fatal("Register err:", err)
+		}
+	}
+}
+
+// Get a blindly signed token from the round's issuing directory for
+// each msg, to be sent to the entry group in gids, so the entry groups
+// can tell a registered client sent the msgs but not which one; nil if
+// submissions need no tokens
+func (c *Client) getTokens(round int, gids []int) []*Token {
+	if !c.params.Auth {
+		return nil
+	}
+	if c.tokenKeys == nil {
+		keys, err := directory.GetTokenKeys(c.dirServers, c.dirKeys)
+		if err != nil {
+			log.Fatal("Token key err:", err)
+		}
+		c.tokenKeys = keys
+	}
+	dir := TokenIssuer(round, len(c.dirServers))
+	tokens := make([]*Token, len(gids))
+	for i, gid := range gids {
+		args := directory.TokenArgs{
+			Round: round,
+			Id:    c.id,
+		}
+		args.Sign(c.keyPair.Priv)
+		var R Point
+		err := c.dirServers[dir].Call("DirectoryRPC.TokenCommit", &args, &R)
+		if err != nil {
+			log.Fatal("Token err:", err)
+		}
+
+		serial := make([]byte, NONCE_LEN)
+		rand.Read(serial)
+		msg := TokenMessage(round, gid, serial)
+		blinding, C := Blind(c.tokenKeys[dir], &R, msg)
+
+		args.C = C
+		args.Sign(c.keyPair.Priv)
+		var s Scalar
+		err = c.dirServers[dir].Call("DirectoryRPC.TokenSign", &args, &s)
+		if err != nil {
+			log.Fatal("Token err:", err)
+		}
+		tokens[i] = &Token{
+			Dir:    dir,
+			Serial: serial,
+			Sig:    Unblind(blinding, &s),
+		}
+	}
+	return tokens
+}
+
 func (c *Client) GenRandPlaintexts() [][]byte {
 	plaintexts := make([][]byte, c.params.NumMsgs)
 	for p := range plaintexts {
@@ -134,6 +354,47 @@ func (c *Client) DownloadMsgs(round int) ([][]byte, error) {
 	return res, nil
 }
 
+// Check with every trustee that the traps this client sent in round
+// were all recovered by their entry groups. Should be called after the
+// round finished, e.g. after DownloadMsgs returns.
+func (c *Client) VerifyTraps(round int) error {
+	if c.params.Mode != TRAP_MODE {
+		return errors.New("Traps are only used in trap mode")
+	}
+
+	c.tlock.Lock()
+	traps := c.traps[round]
+	c.tlock.Unlock()
+
+	for _, addr := range c.directory.Trustees {
+		var reports []*ReportArgs
+		err := c.pool.Call(addr, "TrusteeRPC.Reports", &round, &reports, DEFAULT_TIMEOUT)
+		if err != nil {
+			return err
+		}
+
+		// every reporting member of the entry group must have seen the trap
+		byUid := make(map[int][]*ReportArgs)
+		for _, report := range reports {
+			byUid[report.Uid] = append(byUid[report.Uid], report)
+		}
+		for _, trap := range traps {
+			uid := c.network[0][trap.Gid].Uid
+			comm := Commit(trap)
+			if len(byUid[uid]) == 0 {
+				return fmt.Errorf("No reports from entry group %d", trap.Gid)
+			}
+			for _, report := range byUid[uid] {
+				if !report.CorrectTraps || !MemberCommitment(comm, report.Comms) {
+					return fmt.Errorf("Trap not counted by server %d in entry group %d",
+						report.Sid, trap.Gid)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (c *Client) generateRandomMsgs() []Message {
 	numPts := c.params.MsgSize / PickLen()
 	if c.params.MsgSize%PickLen() != 0 {
@@ -144,17 +405,11 @@ func (c *Client) generateRandomMsgs() []Message {
 
 func (c *Client) generateMessages(round int, plaintexts [][]byte) []Message {
 	if c.params.Mode == TRAP_MODE {
-		buf := new(bytes.Buffer)
-		err := binary.Write(buf, binary.LittleEndian, uint32(round))
-		if err != nil {
-			log.Fatal("Could not write round")
-		}
-
 		trusteeKey := LoadPubKey(c.directory.RoundKeys[round])
 
 		inners := make([]InnerCiphertext, len(plaintexts))
 		for i := range inners {
-			inners[i] = CCA2Encrypt(plaintexts[i], buf.Bytes(), trusteeKey)
+			inners[i] = CCA2Encrypt(plaintexts[i], roundNonce(round), trusteeKey)
 		}
 		msgs := make([]Message, len(inners))
 		for i := range inners {
@@ -167,8 +422,44 @@ func (c *Client) generateMessages(round int, plaintexts [][]byte) []Message {
 	}
 }
 
-func (c *Client) generateTraps(gid int) []Trap {
-	traps := make([]Trap, c.params.NumMsgs)
+// entryGroups picks the entry group of each of numMsgs msgs; the
+// groups learn how many to expect from the client's commitments
+func entryGroups(numMsgs, numGroups, policy int) []int {
+	gids := make([]int, numMsgs)
+	switch policy {
+	case RANDOM_ENTRY:
+		for m := range gids {
+			gids[m] = randInt(numGroups)
+		}
+	default:
+		offset := randInt(numGroups)
+		for m := range gids {
+			gids[m] = (offset + m) % numGroups
+		}
+	}
+	return gids
+}
+
+func randInt(n int) int {
+	r, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		log.Fatal("Could not read rand bytes:", err)
+	}
+	return int(r.Int64())
+}
+
+// the nonce used for CCA2 ciphertexts of a round
+func roundNonce(round int) []byte {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, uint32(round))
+	if err != nil {
+		log.Fatal("Could not write round")
+	}
+	return buf.Bytes()
+}
+
+func (c *Client) generateTraps(gid, n int) []Trap {
+	traps := make([]Trap, n)
 	for t := range traps {
 		traps[t] = GenTrap(gid)
 	}
@@ -181,7 +472,7 @@ func (c *Client) generateTrapMsgs(traps []Trap, msgSize int) []Message {
 		numPts += 1
 	}
 
-	msgs := make([]Message, c.params.NumMsgs)
+	msgs := make([]Message, len(traps))
 	var err error
 	for t := range traps {
 		msgs[t], err = TrapToMessage(traps[t], numPts)
@@ -217,9 +508,9 @@ func (c *Client) generateSubmitArgs(gid, round int, msgs []Message) *SubmitArgs
 	return &args
 }
 
-func (c *Client) generateCommitArgs(gid int, traps []Trap) *CommitArgs {
+func (c *Client) generateCommitArgs(gid, round, numMsgs int, traps []Trap) *CommitArgs {
 	info := ArgInfo{
-		Round: 0,
+		Round: round,
 		Level: 0,
 		Gid:   gid,
 		Cur:   0,
@@ -233,6 +524,7 @@ func (c *Client) generateCommitArgs(gid int, traps []Trap) *CommitArgs {
 
 	args := CommitArgs{
 		Id:      c.id,
+		NumMsgs: numMsgs,
 		Comms:   comms,
 		ArgInfo: info,
 	}
@@ -240,42 +532,37 @@ func (c *Client) generateCommitArgs(gid int, traps []Trap) *CommitArgs {
 }
 
 func (c *Client) submit(gid int, args *SubmitArgs) {
-	group := c.network[0][gid]
-	for _, idx := range args.Group {
-		addr := c.directory.Servers[group.Members[idx]]
-		conn, err := tls.Dial("tcp", addr, c.tlsConfig)
-		if err != nil {
-			log.Fatal(err)
-		}
-		server := rpc.NewClient(conn)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = AtomRPC(server, "ServerRPC.Submit", args, nil, DEFAULT_TIMEOUT)
-		if err != nil {
-			log.Fatal(err)
-		}
-		server.Close()
-	}
+	c.callGroup(gid, args.Group, "ServerRPC.Submit", args)
 }
 
 func (c *Client) commit(gid int, args *CommitArgs) {
-	group := c.network[0][gid]
+	c.callGroup(gid, args.Group, "ServerRPC.Commit", args)
+}
 
-	for _, idx := range args.Group {
+// send args to the given members of an entry group in parallel,
+// reusing the pooled connections
+func (c *Client) callGroup(gid int, idxs []int, method string, args interface{}) {
+	group := c.network[0][gid]
+	errs := make(chan error, len(idxs))
+	for _, idx := range idxs {
 		addr := c.directory.Servers[group.Members[idx]]
-		conn, err := tls.Dial("tcp", addr, c.tlsConfig)
-		if err != nil {
-			log.Fatal(err)
-		}
-		server := rpc.NewClient(conn)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = AtomRPC(server, "ServerRPC.Commit", args, nil, DEFAULT_TIMEOUT)
+		go func(addr string) {
+			errs <- c.pool.Call(addr, method, args, nil, DEFAULT_TIMEOUT)
+		}(addr)
+	}
+
+	for range idxs {
+		err := <-errs
 		if err != nil {
 			log.Fatal(err)
 		}
-		server.Close()
 	}
 }
+
+func (c *Client) Close() {
+	c.pool.Close()
+	for _, dirServer := range c.dirServers {
+		dirServer.Close()
+	}
+	c.dbServer.Close()
+}
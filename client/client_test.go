@@ -0,0 +1,77 @@
+package client
+
+import (
+	"testing"
+)
+
+var numGroups = 4
+var numMsgs = 6
+var numClients = numGroups - 1
+
+var policies = []int{SPLIT_ENTRY, RANDOM_ENTRY}
+
+// count how many msgs each entry group receives when every client
+// picks its groups independently
+func groupCounts(policy int) []int {
+	counts := make([]int, numGroups)
+	for c := 0; c < numClients; c++ {
+		for _, gid := range entryGroups(numMsgs, numGroups, policy) {
+			counts[gid]++
+		}
+	}
+	return counts
+}
+
+func TestSplitEntry(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		counts := make([]int, numGroups)
+		for _, gid := range entryGroups(numMsgs, numGroups, SPLIT_ENTRY) {
+			counts[gid]++
+		}
+		// numMsgs does not split evenly, so groups differ by one
+		for gid := range counts {
+			if counts[gid] < numMsgs/numGroups || counts[gid] > numMsgs/numGroups+1 {
+				t.Error("Uneven split for group", gid, ":", counts[gid])
+			}
+		}
+	}
+}
+
+func TestEntryTotal(t *testing.T) {
+	// the groups learn their counts from the commitments, so all
+	// that matters is that no msg is lost
+	for _, policy := range policies {
+		total := 0
+		for _, count := range groupCounts(policy) {
+			total += count
+		}
+		if total != numClients*numMsgs {
+			t.Error("Policy", policy, "lost msgs in entry group selection")
+		}
+	}
+}
+
+func TestEntryUniform(t *testing.T) {
+	// every msg should land in every group with the same chance
+	trials := 4000
+	for _, policy := range policies {
+		counts := make([][]int, numMsgs)
+		for m := range counts {
+			counts[m] = make([]int, numGroups)
+		}
+		for i := 0; i < trials; i++ {
+			for m, gid := range entryGroups(numMsgs, numGroups, policy) {
+				counts[m][gid]++
+			}
+		}
+		exp := trials / numGroups
+		for m := range counts {
+			for gid, count := range counts[m] {
+				if count < exp*3/4 || count > exp*5/4 {
+					t.Error("Policy", policy, "put msg", m, "in group", gid,
+						count, "times out of", trials)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+
+	. "github.com/kwonalbert/atom/crypto"
+)
+
+// Replies let a sender stay anonymous and still hear back: the sender
+// attaches a one-time public key to its msg, and whoever reads the msg
+// from the DB can publish an answer in a later round that only the
+// holder of the one-time key can open. Requests and replies are padded
+// to exactly MsgSize, so their length gives nothing away.
+
+// how many rounds after its request a reply is looked for
+const REPLY_ROUNDS = 4
+
+// NewReplyRequest prepends a fresh one-time public key to body. The
+// result should be submitted in round; replies to it are found with
+// OpenReplies or DownloadReplies.
+func (c *Client) NewReplyRequest(round int, body []byte) ([]byte, error) {
+	padded, err := pad(body, c.params.MsgSize-PointLen())
+	if err != nil {
+		return nil, errors.New("Reply request too long")
+	}
+
+	key := GenKey()
+	pub, err := key.Pub.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	c.rlock.Lock()
+	c.replyKeys[round] = append(c.replyKeys[round], key)
+	c.rlock.Unlock()
+
+	return append(pub, padded...), nil
+}
+
+// ParseReplyRequest splits a msg made by NewReplyRequest into the
+// sender's one-time key and the body.
+func ParseReplyRequest(msg []byte) (*PublicKey, []byte, error) {
+	if len(msg) < PointLen() {
+		return nil, nil, errors.New("Reply request too short")
+	}
+	pub := new(PublicKey)
+	err := pub.UnmarshalBinary(msg[:PointLen()])
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := unpad(msg[PointLen():])
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub, body, nil
+}
+
+// NewReply encrypts body to the one-time key in request, which was
+// published in round. The reply uses the same CCA2 format as the
+// trustee ciphertexts, and should be submitted in any later round.
+func (c *Client) NewReply(round int, request []byte, body []byte) ([]byte, error) {
+	pub, _, err := ParseReplyRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	padded, err := pad(body, c.params.MsgSize-PointLen()-CCA2_OVERHEAD)
+	if err != nil {
+		return nil, errors.New("Reply too long")
+	}
+
+	inner := CCA2Encrypt(padded, roundNonce(round), pub)
+	return inner.MarshalBinary()
+}
+
+// OpenReplies returns the bodies of all msgs that open under one of
+// the one-time keys this client attached to its earlier requests. A
+// key is dropped once its reply is opened.
+func (c *Client) OpenReplies(msgs [][]byte) [][]byte {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	var replies [][]byte
+	for _, msg := range msgs {
+		if len(msg) < PointLen()+CCA2_OVERHEAD {
+			continue
+		}
+		var inner InnerCiphertext
+		err := inner.UnmarshalBinary(msg)
+		if err != nil {
+			continue
+		}
+
+	search:
+		for round, keys := range c.replyKeys {
+			for k, key := range keys {
+				padded, err := CCA2Decrypt(inner, roundNonce(round), key.Priv, key.Pub)
+				if err != nil {
+					continue
+				}
+				body, err := unpad(padded)
+				if err != nil {
+					continue
+				}
+				replies = append(replies, body)
+				c.replyKeys[round] = append(keys[:k:k], keys[k+1:]...)
+				if len(c.replyKeys[round]) == 0 {
+					delete(c.replyKeys, round)
+				}
+				break search
+			}
+		}
+	}
+	return replies
+}
+
+// DownloadReplies reads the msgs of round from the DB and opens every
+// reply addressed to this client. Rounds are expected in order: the
+// keys of requests too old to get replies after round are dropped.
+func (c *Client) DownloadReplies(round int) ([][]byte, error) {
+	msgs, err := c.DownloadMsgs(round)
+	if err != nil {
+		return nil, err
+	}
+	replies := c.OpenReplies(msgs)
+	c.expireReplyKeys(round)
+	return replies, nil
+}
+
+// expireReplyKeys drops the keys of requests whose replies would have
+// come by round
+func (c *Client) expireReplyKeys(round int) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	for r := range c.replyKeys {
+		if r+REPLY_ROUNDS <= round {
+			delete(c.replyKeys, r)
+		}
+	}
+}
+
+// pad prefixes body with its length and fills it up to size bytes
+func pad(body []byte, size int) ([]byte, error) {
+	if 2+len(body) > size || len(body) > 0xffff {
+		return nil, errors.New("Body too long")
+	}
+	padded := make([]byte, size)
+	binary.BigEndian.PutUint16(padded, uint16(len(body)))
+	copy(padded[2:], body)
+	return padded, nil
+}
+
+// unpad returns the body pad put in b
+func unpad(b []byte) ([]byte, error) {
+	if len(b) < 2 {
+		return nil, errors.New("Padded body too short")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if 2+n > len(b) {
+		return nil, errors.New("Padded body too long")
+	}
+	return b[2 : 2+n], nil
+}
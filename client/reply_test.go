@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	. "github.com/kwonalbert/atom/common"
+	. "github.com/kwonalbert/atom/crypto"
+)
+
+func newReplyClient() *Client {
+	return &Client{
+		params: SystemParameter{
+			MsgSize: 160,
+		},
+		replyKeys: make(map[int][]*KeyPair),
+		rlock:     new(sync.Mutex),
+	}
+}
+
+func TestReply(t *testing.T) {
+	sender := newReplyClient()
+	responder := newReplyClient()
+	other := newReplyClient()
+
+	request, err := sender.NewReplyRequest(0, []byte("who are you?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body, err := ParseReplyRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, []byte("who are you?")) {
+		t.Error("Mismatched request body")
+	}
+
+	// an unrelated request in the same round
+	_, err = other.NewReplyRequest(0, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := responder.NewReply(0, request, []byte("a friend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(request) != sender.params.MsgSize || len(reply) != sender.params.MsgSize {
+		t.Error("Request and reply not padded to a msg:", len(request), len(reply))
+	}
+
+	// the db output of a later round
+	msgs := [][]byte{request, reply, make([]byte, 160)}
+
+	replies := sender.OpenReplies(msgs)
+	if len(replies) != 1 || !bytes.Equal(replies[0], []byte("a friend")) {
+		t.Error("Could not open reply")
+	}
+	if len(other.OpenReplies(msgs)) != 0 {
+		t.Error("Opened someone else's reply")
+	}
+	if len(sender.replyKeys) != 0 || len(sender.OpenReplies(msgs)) != 0 {
+		t.Error("Key kept after its reply was opened")
+	}
+}
+
+func TestReplyExpire(t *testing.T) {
+	c := newReplyClient()
+	for round := 0; round < 3; round++ {
+		if _, err := c.NewReplyRequest(round, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.expireReplyKeys(1 + REPLY_ROUNDS)
+	if len(c.replyKeys) != 1 || c.replyKeys[2] == nil {
+		t.Error("Wrong reply keys expired")
+	}
+}
+
+func TestReplyTooLong(t *testing.T) {
+	c := newReplyClient()
+	_, err := c.NewReplyRequest(0, make([]byte, c.params.MsgSize))
+	if err == nil {
+		t.Error("Accepted request larger than a msg")
+	}
+
+	request, err := c.NewReplyRequest(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.NewReply(0, request, make([]byte, c.params.MsgSize))
+	if err == nil {
+		t.Error("Accepted reply larger than a msg")
+	}
+}
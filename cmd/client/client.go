@@ -3,21 +3,38 @@ package main
 import (
 	"flag"
 	"log"
+	"strings"
 
+	"github.com/kwonalbert/atom/atomrpc"
 	"github.com/kwonalbert/atom/client"
 )
 
 var (
-	dirAddr = flag.String("dirAddr", "127.0.0.1:8000", "Directory address")
+	dirAddr = flag.String("dirAddr", "127.0.0.1:8000", "Directory addresses, comma separated")
 	dbAddr  = flag.String("dbAddr", "127.0.0.1:10001", "Database address")
+	dirCert = flag.String("dirCert", "keys/directory_cert.pem", "Directory certificates, comma separated")
+	dbCert  = flag.String("dbCert", "keys/db_cert.pem", "Database certificate")
 	id      = flag.Int("id", 0, "Public ID of the client")
+	entry   = flag.Int("entry", client.SPLIT_ENTRY, "Entry group selection policy")
+	keyFile = flag.String("keyFile", "", "Client key file, for directories that approve client keys")
+	quorum  = flag.Int("quorum", 0, "# of directories that must agree, 0 for all")
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	flag.Parse()
 
-	c, err := client.NewClient(*id, []string{*dirAddr}, *dbAddr)
+	dirCerts, err := atomrpc.ReadCerts(strings.Split(*dirCert, ","))
+	if err != nil {
+		log.Fatal("Certificate err:", err)
+	}
+	dbCerts, err := atomrpc.ReadCerts([]string{*dbCert})
+	if err != nil {
+		log.Fatal("Certificate err:", err)
+	}
+
+	c, err := client.NewClient(*id, *keyFile, strings.Split(*dirAddr, ","), dirCerts,
+		*dbAddr, dbCerts[0])
 	if err != nil {
 		log.Fatal("Could not start client:", err)
 	}
@@ -25,13 +42,17 @@ func main() {
 	if *id == 0 {
 		log.Println("Setting up clients..")
 	}
+	if *quorum > 0 {
+		c.SetQuorum(*quorum)
+	}
 	c.Setup()
+	c.SetEntryPolicy(*entry)
 
 	if *id == 0 {
 		log.Println("Sending msg")
 	}
 
-	c.Submit(*id, 0, c.GenRandPlaintexts())
+	c.Submit(0, c.GenRandPlaintexts())
 
 	if *id == 0 {
 		log.Println("Done sending")
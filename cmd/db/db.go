@@ -9,11 +9,14 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/kwonalbert/atom/atomrpc"
 	"github.com/kwonalbert/atom/db"
 )
 
 var (
-	addr = flag.String("dbAddr", "127.0.0.1:10001", "Database address")
+	addr   = flag.String("dbAddr", "127.0.0.1:10001", "Database address")
+	cert   = flag.String("cert", "keys/db_cert.pem", "TLS certificate, created if missing")
+	tlsKey = flag.String("tlsKey", "keys/db_key.pem", "TLS key, created with the certificate")
 )
 
 func main() {
@@ -25,7 +28,12 @@ func main() {
 		log.Fatal(err)
 	}
 
-	_, err = db.NewDB(port)
+	tlsCert, _, err := atomrpc.LoadTLSConfig(*cert, *tlsKey)
+	if err != nil {
+		log.Fatal("TLS err:", err)
+	}
+
+	_, err = db.NewDB(port, tlsCert)
 	if err != nil {
 		log.Fatal("Could not start db:", err)
 	}
@@ -9,23 +9,23 @@ import (
 	"strings"
 	"syscall"
 
-	. "github.com/kwonalbert/atom/common"
+	"github.com/kwonalbert/atom/atomrpc"
 	"github.com/kwonalbert/atom/directory"
 )
 
 var (
 	id          = flag.Int("id", 0, "unique id")
 	addr        = flag.String("dirAddr", "127.0.0.1:8000", "Directory address")
-	perGroup    = flag.Int("perGroup", 1, "# of servers per group")
-	numServers  = flag.Int("numServers", 0, "# of servers")
-	numClients  = flag.Int("numClients", 0, "# of clients")
-	numGroups   = flag.Int("numGroups", 0, "# of groups")
-	numTrustees = flag.Int("numTrustees", 0, "# of trustees")
-	numMsgs     = flag.Int("numMsgs", 1, "# of msgs per group")
-	msgSize     = flag.Int("msgSize", 1, "size of the message in group elements")
-	mode        = flag.Int("mode", TRAP_MODE, "Operation mode")
-	net         = flag.Int("net", BUTTERFLY, "Network topology")
-	branch      = flag.Int("branch", 2, "Branching factor for padding network")
+	keyFile     = flag.String("keyFile", "", "Directory key file, for configs that commit to directory keys (fresh key if empty)")
+	config      = flag.String("config", "config.json", "Deployment config, see directory.Config")
+	store       = flag.String("store", "", "File to persist the directory state in (none if empty)")
+	cert        = flag.String("cert", "keys/directory_cert.pem", "TLS certificate, created if missing")
+	tlsKey      = flag.String("tlsKey", "keys/directory_key.pem", "TLS key, created with the certificate")
+	roundPeriod = flag.Duration("roundPeriod", 0, "Time between rounds (no schedule if 0)")
+	roundWindow = flag.Duration("roundWindow", 0, "How long a round takes submissions")
+	httpAddr    = flag.String("http", "", "Address to serve the JSON view on (off if empty)")
+	peers       = flag.String("peers", "", "All directory addresses, comma separated, for the JSON view")
+	peerCerts   = flag.String("peerCerts", "", "Certificates of -peers, comma separated")
 )
 
 func main() {
@@ -36,14 +36,58 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	_, err = directory.NewDirectory(*id, port, *mode, *net,
-		*numServers, *numGroups, *perGroup, *numTrustees,
-		*numMsgs, *msgSize, *perGroup-1,
-		*numClients)
+	conf, err := directory.LoadConfig(*config)
+	if err != nil {
+		log.Fatal("Config err:", err)
+	}
+
+	tlsCert, _, err := atomrpc.LoadTLSConfig(*cert, *tlsKey)
+	if err != nil {
+		log.Fatal("TLS err:", err)
+	}
+
+	d, err := directory.NewDirectory(*id, port, *keyFile, conf, *store, tlsCert)
 	if err != nil {
 		log.Fatal("Directory err:", err)
 	}
 
+	if *roundPeriod > 0 {
+		started, err := d.StartSchedule(*roundPeriod, *roundWindow)
+		if err != nil {
+			log.Fatal("Schedule err:", err)
+		} else if !started {
+			log.Println("Keeping the restored round schedule")
+		}
+	}
+
+	if *peers != "" {
+		certs, err := atomrpc.ReadCerts(strings.Split(*peerCerts, ","))
+		if err != nil {
+			log.Fatal("Peer certificates err:", err)
+		}
+		d.SetPeers(strings.Split(*peers, ","), certs)
+	}
+	if *httpAddr != "" {
+		err = d.ListenHTTP(*httpAddr)
+		if err != nil {
+			log.Fatal("HTTP err:", err)
+		}
+	}
+
+	// SIGHUP moves to the next epoch with the servers that joined or
+	// left since the last one, once the current round is over
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Moving to the next epoch after the current round")
+			err := d.NextEpochBetweenRounds()
+			if err != nil {
+				log.Println("Epoch err:", err)
+			}
+		}
+	}()
+
 	kill := make(chan os.Signal)
 	signal.Notify(kill, syscall.SIGINT, syscall.SIGTERM)
 	<-kill
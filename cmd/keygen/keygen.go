@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"io/ioutil"
 	"log"
 	"os"
 
@@ -12,8 +13,16 @@ import (
 var (
 	serverKeys  = flag.String("serverKeys", "server_keys.json", "Key file")
 	trusteeKeys = flag.String("trusteeKeys", "trustee_keys.json", "Key file")
+	clientKeys  = flag.String("clientKeys", "client_keys.json", "Key file")
+	dirKeys     = flag.String("dirKeys", "directory_keys.json", "Key file")
+	serverPubs  = flag.String("serverPubs", "server_pubs.json", "Public key file for the directory")
+	trusteePubs = flag.String("trusteePubs", "trustee_pubs.json", "Public key file for the directory")
+	clientPubs  = flag.String("clientPubs", "client_pubs.json", "Public key file for the directory")
+	dirPubs     = flag.String("dirPubs", "directory_pubs.json", "Public key file for the config")
 	numServers  = flag.Int("numServers", 0, "# of servers")
 	numTrustees = flag.Int("numTrustees", 0, "# of trustees")
+	numClients  = flag.Int("numClients", 0, "# of clients")
+	numDirs     = flag.Int("numDirs", 0, "# of directories")
 )
 
 func main() {
@@ -27,17 +36,45 @@ func main() {
 	if err != nil {
 		log.Fatal("file err:", err)
 	}
+	clientFile, err := os.Create(*clientKeys)
+	if err != nil {
+		log.Fatal("file err:", err)
+	}
+	dirFile, err := os.Create(*dirKeys)
+	if err != nil {
+		log.Fatal("file err:", err)
+	}
 
 	sks := make([]crypto.HexKeyPair, *numServers)
+	sps := make([]string, *numServers)
 	for s := 0; s < *numServers; s++ {
 		key := crypto.GenKey()
 		sks[s] = crypto.DumpKey(key)
+		sps[s] = sks[s].Pub
 	}
 
 	tks := make([]crypto.HexKeyPair, *numTrustees)
+	tps := make([]string, *numTrustees)
 	for t := 0; t < *numTrustees; t++ {
 		key := crypto.GenKey()
 		tks[t] = crypto.DumpKey(key)
+		tps[t] = tks[t].Pub
+	}
+
+	cks := make([]crypto.HexKeyPair, *numClients)
+	cps := make([]string, *numClients)
+	for c := 0; c < *numClients; c++ {
+		key := crypto.GenKey()
+		cks[c] = crypto.DumpKey(key)
+		cps[c] = cks[c].Pub
+	}
+
+	dks := make([]crypto.HexKeyPair, *numDirs)
+	dps := make([]string, *numDirs)
+	for d := 0; d < *numDirs; d++ {
+		key := crypto.GenKey()
+		dks[d] = crypto.DumpKey(key)
+		dps[d] = dks[d].Pub
 	}
 
 	sb, err := json.MarshalIndent(sks, "", "  ")
@@ -48,10 +85,41 @@ func main() {
 	if err != nil {
 		log.Fatal("failed marshaling keys:", err)
 	}
+	cb, err := json.MarshalIndent(cks, "", "  ")
+	if err != nil {
+		log.Fatal("failed marshaling keys:", err)
+	}
+
+	db, err := json.MarshalIndent(dks, "", "  ")
+	if err != nil {
+		log.Fatal("failed marshaling keys:", err)
+	}
 
 	serverFile.Write(sb)
 	trusteeFile.Write(tb)
+	clientFile.Write(cb)
+	dirFile.Write(db)
 
 	serverFile.Close()
 	trusteeFile.Close()
+	clientFile.Close()
+	dirFile.Close()
+
+	// the directory only needs to know which keys to accept
+	writePubs(*serverPubs, sps)
+	writePubs(*trusteePubs, tps)
+	writePubs(*clientPubs, cps)
+	// the directories commit to theirs in the config
+	writePubs(*dirPubs, dps)
+}
+
+func writePubs(fn string, pubs []string) {
+	b, err := json.MarshalIndent(pubs, "", "  ")
+	if err != nil {
+		log.Fatal("failed marshaling keys:", err)
+	}
+	err = ioutil.WriteFile(fn, b, 0644)
+	if err != nil {
+		log.Fatal("file err:", err)
+	}
 }
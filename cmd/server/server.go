@@ -5,17 +5,22 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"github.com/kwonalbert/atom/atomrpc"
 	"github.com/kwonalbert/atom/server"
 )
 
 var (
 	keyFile = flag.String("keyFile", "keys/server_keys.json", "Server key file")
-	dirAddr = flag.String("dirAddr", "127.0.0.1:8000", "Directory address")
+	dirAddr = flag.String("dirAddr", "127.0.0.1:8000", "Directory addresses, comma separated")
 	dbAddr  = flag.String("dbAddr", "127.0.0.1:10001", "Database address")
+	dirCert = flag.String("dirCert", "keys/directory_cert.pem", "Directory certificates, comma separated")
+	dbCert  = flag.String("dbCert", "keys/db_cert.pem", "Database certificate")
 	addr    = flag.String("addr", "127.0.0.1:8001", "Public address of server")
 	id      = flag.Int("id", 0, "Public ID of the server")
+	quorum  = flag.Int("quorum", 0, "# of directories that must agree, 0 for all")
 )
 
 func main() {
@@ -24,13 +29,26 @@ func main() {
 
 	kill := make(chan os.Signal)
 
-	s, err := server.NewServer(*addr, *id, *keyFile, []string{*dirAddr}, *dbAddr)
+	dirCerts, err := atomrpc.ReadCerts(strings.Split(*dirCert, ","))
+	if err != nil {
+		log.Fatal("Certificate err:", err)
+	}
+	dbCerts, err := atomrpc.ReadCerts([]string{*dbCert})
+	if err != nil {
+		log.Fatal("Certificate err:", err)
+	}
+
+	s, err := server.NewServer(*addr, *id, *keyFile,
+		strings.Split(*dirAddr, ","), dirCerts, *dbAddr, dbCerts[0])
 	if err != nil {
 		log.Fatal("Could not start server:", err)
 	}
 
 	signal.Notify(kill, syscall.SIGINT, syscall.SIGTERM)
 
+	if *quorum > 0 {
+		s.SetQuorum(*quorum)
+	}
 	s.Setup()
 
 	for {
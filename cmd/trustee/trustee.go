@@ -4,29 +4,61 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/kwonalbert/atom/atomrpc"
 	"github.com/kwonalbert/atom/trustee"
 )
 
 var (
 	keyFile = flag.String("keyFile", "keys/server_keys.json", "Server key file")
-	dirAddr = flag.String("dirAddr", "127.0.0.1:8000", "Directory address")
+	dirAddr = flag.String("dirAddr", "127.0.0.1:8000", "Directory addresses, comma separated")
+	dirCert = flag.String("dirCert", "keys/directory_cert.pem", "Directory certificates, comma separated")
 	addr    = flag.String("addr", "127.0.0.1:8001", "Public address of server")
 	id      = flag.Int("id", 0, "Public ID of the server")
+	quorum  = flag.Int("quorum", 0, "# of directories that must agree, 0 for all")
+	audit   = flag.String("audit", "", "File to append the verdicts to")
+
+	deadline = flag.Duration("deadline", 0, "Time to wait for reports after the first one, 0 for no limit")
+	policy   = flag.Int("policy", trustee.WITHHOLD_LATE, "At the deadline, 0 withholds, 1 releases if every group has quorum")
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	flag.Parse()
 
-	t, err := trustee.NewTrustee(*addr, *id, *keyFile, []string{*dirAddr})
+	dirCerts, err := atomrpc.ReadCerts(strings.Split(*dirCert, ","))
+	if err != nil {
+		log.Fatal("Certificate err:", err)
+	}
+
+	t, err := trustee.NewTrustee(*addr, *id, *keyFile,
+		strings.Split(*dirAddr, ","), dirCerts)
 	if err != nil {
 		log.Fatal("Trustee err:", err)
 	}
 
+	if *quorum > 0 {
+		t.SetQuorum(*quorum)
+	}
+	if *deadline > 0 {
+		t.SetDeadline(*deadline, *policy)
+	}
+	if *audit != "" {
+		err = t.SetAuditLog(*audit)
+		if err != nil {
+			log.Fatal("Audit log err:", err)
+		}
+	}
+	kill := make(chan os.Signal, 1)
+	signal.Notify(kill, syscall.SIGINT, syscall.SIGTERM)
+
 	t.Setup()
-	t.RegisterRound()
+	go t.Run()
 
-	kill := make(chan os.Signal)
 	<-kill
+	t.Close()
+	os.Exit(0)
 }
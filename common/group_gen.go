@@ -30,11 +30,22 @@ func GenerateGroups(seed [SEED_LEN]byte, netType,
 	publicKeys []*PublicKey) [][]*Group {
 	rand := NewRandReader(seed[:])
 
+	// servers that left have no key, and are never picked
+	var active []int
+	for id := 0; id < numServers; id++ {
+		if publicKeys[id] != nil {
+			active = append(active, id)
+		}
+	}
+
 	// replicate the groups across levels
 	// NOTE: wouldn't replicate it for the throughput maximized version
 	baseGroups := make([][]int, numGroups)
 	for gid := range baseGroups {
-		baseGroups[gid] = GenRandomGroup(numServers, numGroups, perGroup, rand)
+		baseGroups[gid] = GenRandomGroup(len(active), numGroups, perGroup, rand)
+		for m := range baseGroups[gid] {
+			baseGroups[gid][m] = active[baseGroups[gid][m]]
+		}
 		sort.Ints(baseGroups[gid])
 		baseGroups[gid] = append(baseGroups[gid][gid%perGroup:],
 			baseGroups[gid][:gid%perGroup]...)
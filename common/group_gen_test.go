@@ -22,3 +22,19 @@ func TestGenerateGroups(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateGroupsSkipsMissing(t *testing.T) {
+	numServers := 8
+	_, pubs, _ := GenKeys(numServers)
+	pubs[3] = nil
+	pubs[5] = nil
+
+	groupss := GenerateGroups(SEED, SQUARE, numServers, 4, 4, 2, pubs)
+	for level := range groupss {
+		for _, group := range groupss[level] {
+			if IsMember(3, group.Members) || IsMember(5, group.Members) {
+				t.Error("Server without a key in a group:", group.Members)
+			}
+		}
+	}
+}
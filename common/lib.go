@@ -2,6 +2,8 @@ package common
 
 import (
 	"math"
+
+	. "github.com/kwonalbert/atom/crypto"
 )
 
 // implementes utility and helper functions for atom
@@ -27,6 +29,15 @@ func ByteSliceEqual(s1, s2 []byte) bool {
 	return true
 }
 
+func MemberCommitment(comm Commitment, comms []Commitment) bool {
+	for c := range comms {
+		if comm == comms[c] {
+			return true
+		}
+	}
+	return false
+}
+
 func IsMember(val int, set []int) bool {
 	for _, v := range set {
 		if val == v {
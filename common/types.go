@@ -23,10 +23,15 @@ type SystemParameter struct {
 	NumTrustees int // number of trsutees in trap mode
 	NumLevels   int // number of levels
 
-	NumMsgs int // number of msgs per group
-	MsgSize int // number of bytes of plaintext msg
+	NumClients int // number of clients submitting every round
+	NumMsgs    int // number of msgs per client
+	MsgSize    int // number of bytes of plaintext msg
 
 	Threshold int // threshold, if it's used
+
+	TrusteeThreshold int // # of trustees needed to open a round
+
+	Auth bool // submissions require an anonymous credential
 }
 
 // network nodes
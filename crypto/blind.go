@@ -0,0 +1,58 @@
+package crypto
+
+import (
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/random"
+)
+
+// Blind schnorr signatures. The signer never sees the msg nor the
+// final signature, which verifies using VerifyBlind (but not Verify).
+//
+//   signer:    k, R = kG                       -> R
+//   user:      a, b, R' = R + aG + bX
+//              c' = H(R', X, m), c = c' + b    -> c
+//   signer:    s = k + cx                      -> s
+//   user:      sig = (R', s + a)
+
+// Blinding factors kept by the user between Blind and Unblind
+type Blinding struct {
+	a kyber.Scalar
+	R kyber.Point // blinded commitment
+}
+
+// Signer's first move; k must be used for a single BlindSign
+func BlindCommit() (*Scalar, *Point) {
+	k := SUITE.Scalar().Pick(random.New())
+	R := SUITE.Point().Mul(k, nil)
+	return &Scalar{k}, &Point{R}
+}
+
+// Blind the signer's commitment R for msg, and return the challenge
+// to send back to the signer
+func Blind(X *PublicKey, R *Point, msg []byte) (*Blinding, *Scalar) {
+	rnd := random.New()
+	a := SUITE.Scalar().Pick(rnd)
+	b := SUITE.Scalar().Pick(rnd)
+
+	Rbar := SUITE.Point().Mul(a, nil)
+	Rbar = Rbar.Add(R.p, Rbar)
+	Rbar = Rbar.Add(Rbar, SUITE.Point().Mul(b, X.p))
+
+	c := challenge(blindDomain, Rbar, X.p, msg)
+	c = c.Add(c, b)
+	return &Blinding{a: a, R: Rbar}, &Scalar{c}
+}
+
+// Signer's response to a blinded challenge
+func BlindSign(priv *PrivateKey, k *Scalar, c *Scalar) *Scalar {
+	s := SUITE.Scalar().Mul(c.s, priv.s)
+	return &Scalar{s.Add(k.s, s)}
+}
+
+// Turn the signer's response into a signature on the blinded msg
+func Unblind(b *Blinding, s *Scalar) *Signature {
+	return &Signature{
+		R: &Point{b.R},
+		S: &Scalar{SUITE.Scalar().Add(s.s, b.a)},
+	}
+}
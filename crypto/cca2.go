@@ -10,6 +10,9 @@ import (
 	"golang.org/x/crypto/sha3"
 )
 
+// number of bytes CCA2Encrypt adds to the plaintext, not counting R
+const CCA2_OVERHEAD = secretbox.Overhead
+
 func CCA2Encrypt(plaintext []byte, nonce []byte, X *PublicKey) InnerCiphertext {
 	rnd := random.New()
 
@@ -41,9 +44,16 @@ func CCA2Encrypt(plaintext []byte, nonce []byte, X *PublicKey) InnerCiphertext {
 
 func CCA2Decrypt(inner InnerCiphertext, nonce []byte,
 	x *PrivateKey, X *PublicKey) ([]byte, error) {
+	shared := &Point{SUITE.Point().Mul(x.s, inner.R.p)}
+	return CCA2DecryptShared(inner, nonce, shared, X)
+}
 
-	shared := SUITE.Point().Mul(x.s, inner.R.p)
-	sharedBytes, err := shared.MarshalBinary()
+// CCA2DecryptShared opens inner given x*R instead of x, e.g. combined
+// from the partial decryptions of threshold trustees
+func CCA2DecryptShared(inner InnerCiphertext, nonce []byte,
+	shared *Point, X *PublicKey) ([]byte, error) {
+
+	sharedBytes, err := shared.p.MarshalBinary()
 	if err != nil {
 		log.Fatal("Could not marshal rand")
 	}
@@ -1,8 +1,10 @@
 package crypto
 
 import (
+	"bytes"
 	"encoding/binary"
 	"runtime"
+	"sort"
 	"sync"
 
 	"github.com/dedis/kyber/group/edwards25519"
@@ -91,9 +93,11 @@ func Reencrypt(x *PrivateKey, XBar *PublicKey, c Ciphertext) Ciphertext {
 }
 
 func ReencryptBatches(priv *PrivateKey, pubKeys []*PublicKey, batches [][]Ciphertext) [][]Ciphertext {
-	numBatches := len(batches)
-	batchSize := len(batches[0])
-	k := numBatches * batchSize
+	// batches need not be the same size
+	k := 0
+	for b := range batches {
+		k += len(batches[b])
+	}
 	ciphertexts := make([]Ciphertext, k)
 	pubs := make([]*PublicKey, k)
 	idx := 0
@@ -165,3 +169,19 @@ func VerifyCommitment(trap Trap, comm Commitment) bool {
 		return false
 	}
 }
+
+// CommitSet commits to a set of trap commitments, in any order
+func CommitSet(comms []Commitment) Commitment {
+	sorted := make([]Commitment, len(comms))
+	copy(sorted, comms)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+	h := sha3.New256()
+	for _, comm := range sorted {
+		h.Write(comm[:])
+	}
+	var set Commitment
+	copy(set[:], h.Sum(nil))
+	return set
+}
@@ -15,6 +15,11 @@ func PickLen() int {
 	return refPt.EmbedLen()
 }
 
+// number of bytes in a marshalled point or public key
+func PointLen() int {
+	return refPt.MarshalSize()
+}
+
 func compareArray(arr1, arr2 []byte) bool {
 	if len(arr1) != len(arr2) {
 		return false
@@ -0,0 +1,90 @@
+package crypto
+
+import (
+	"errors"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/random"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Chaum-Pedersen proof that log_G(X) == log_H(xH)
+type DLEQProof struct {
+	C *Scalar
+	S *Scalar
+}
+
+func hashPoints(pts ...kyber.Point) kyber.Scalar {
+	var inp []byte
+	for _, pt := range pts {
+		b, _ := pt.MarshalBinary()
+		inp = append(inp, b...)
+	}
+	cbin := sha3.Sum256(inp)
+	return SUITE.Scalar().SetBytes(cbin[:])
+}
+
+// Compute xH, and prove it uses the same x as the public key
+func ProveDLEQ(x *PrivateKey, H *Point) (*Point, DLEQProof) {
+	X := SUITE.Point().Mul(x.s, nil)
+	xH := SUITE.Point().Mul(x.s, H.p)
+
+	w := SUITE.Scalar().Pick(random.New())
+	A := SUITE.Point().Mul(w, nil)
+	B := SUITE.Point().Mul(w, H.p)
+
+	c := hashPoints(X, H.p, xH, A, B)
+	s := SUITE.Scalar().Mul(c, x.s)
+	s = s.Sub(w, s)
+	return &Point{xH}, DLEQProof{
+		C: &Scalar{c},
+		S: &Scalar{s},
+	}
+}
+
+func VerifyDLEQ(X *PublicKey, H, xH *Point, proof DLEQProof) error {
+	if proof.C == nil || proof.S == nil {
+		return errors.New("Missing DLEQ proof")
+	}
+	A := SUITE.Point().Mul(proof.S.s, nil)
+	A = A.Add(A, SUITE.Point().Mul(proof.C.s, X.p))
+	B := SUITE.Point().Mul(proof.S.s, H.p)
+	B = B.Add(B, SUITE.Point().Mul(proof.C.s, xH.p))
+
+	c := hashPoints(X.p, H.p, xH.p, A, B)
+	if !c.Equal(proof.C.s) {
+		return errors.New("DLEQ proof verify failed")
+	}
+	return nil
+}
+
+// a point with unknown discrete log, derived from input
+func hashToPoint(input []byte) *Point {
+	return &Point{SUITE.Point().Pick(SUITE.XOF(input))}
+}
+
+// Verifiable random function. The output is fixed by the key and the
+// input, and anyone with the public key can check it using gamma and
+// the proof.
+func VRF(x *PrivateKey, input []byte) ([]byte, *Point, DLEQProof) {
+	gamma, proof := ProveDLEQ(x, hashToPoint(input))
+	return vrfOutput(gamma), gamma, proof
+}
+
+func VerifyVRF(X *PublicKey, input []byte, gamma *Point, proof DLEQProof) ([]byte, error) {
+	if gamma == nil {
+		return nil, errors.New("Missing VRF output")
+	}
+	err := VerifyDLEQ(X, hashToPoint(input), gamma, proof)
+	if err != nil {
+		return nil, err
+	}
+	return vrfOutput(gamma), nil
+}
+
+func vrfOutput(gamma *Point) []byte {
+	b, _ := gamma.MarshalBinary()
+	out := sha3.Sum256(b)
+	return out[:]
+}
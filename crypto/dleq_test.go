@@ -0,0 +1,44 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDLEQ(t *testing.T) {
+	key := GenKey()
+	H := GenPoints(1)[0]
+
+	xH, proof := ProveDLEQ(key.Priv, H)
+	if err := VerifyDLEQ(key.Pub, H, xH, proof); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyDLEQ(GenKey().Pub, H, xH, proof); err == nil {
+		t.Error("DLEQ proof verified for the wrong key")
+	}
+	if err := VerifyDLEQ(key.Pub, H, GenPoints(1)[0], proof); err == nil {
+		t.Error("DLEQ proof verified for the wrong point")
+	}
+}
+
+func TestVRF(t *testing.T) {
+	key := GenKey()
+	input := []byte("epoch 0")
+
+	out1, gamma, proof := VRF(key.Priv, input)
+	out2, _, _ := VRF(key.Priv, input)
+	if !bytes.Equal(out1, out2) {
+		t.Error("VRF output is not deterministic")
+	}
+
+	res, err := VerifyVRF(key.Pub, input, gamma, proof)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(res, out1) {
+		t.Error("Mismatched VRF output")
+	}
+	if _, err := VerifyVRF(key.Pub, []byte("epoch 1"), gamma, proof); err == nil {
+		t.Error("VRF verified for the wrong input")
+	}
+}
@@ -75,6 +75,21 @@ func ReadKeys(fn string) ([]HexKeyPair, error) {
 	return keys, nil
 }
 
+// ReadPubKeys reads a list of hex encoded public keys
+func ReadPubKeys(fn string) ([]string, error) {
+	bs, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	err = json.Unmarshal(bs, &keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
 func DumpPrivKey(priv *PrivateKey) string {
 	b, err := priv.s.MarshalBinary()
 	if err != nil {
@@ -112,16 +127,25 @@ func LoadPrivKey(priv string) *PrivateKey {
 }
 
 func LoadPubKey(pub string) *PublicKey {
-	pb, err := hex.DecodeString(pub)
+	pubKey, err := ParsePubKey(pub)
 	if err != nil {
 		log.Fatal("Loading malformed keys", err)
 	}
+	return pubKey
+}
+
+// ParsePubKey is LoadPubKey for keys from untrusted sources
+func ParsePubKey(pub string) (*PublicKey, error) {
+	pb, err := hex.DecodeString(pub)
+	if err != nil {
+		return nil, err
+	}
 	pubKey := SUITE.Point()
 	err = pubKey.UnmarshalBinary(pb)
 	if err != nil {
-		log.Fatal("Loading malformed keys", err)
+		return nil, err
 	}
-	return &PublicKey{pubKey}
+	return &PublicKey{pubKey}, nil
 }
 
 func LoadKey(key HexKeyPair) *KeyPair {
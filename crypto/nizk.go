@@ -122,9 +122,11 @@ func ProveReencrypt(x *PrivateKey, XBar *PublicKey, c Ciphertext) (Ciphertext, R
 }
 
 func ProveReencryptBatches(priv *PrivateKey, neighborKeys []*PublicKey, batches [][]Ciphertext) ([][]Ciphertext, [][]ReencProof) {
-	numBatches := len(batches)
-	batchSize := len(batches[0])
-	k := numBatches * batchSize
+	// batches need not be the same size
+	k := 0
+	for b := range batches {
+		k += len(batches[b])
+	}
 	ciphertexts := make([]Ciphertext, k)
 	proofs := make([]ReencProof, k)
 	pubs := make([]*PublicKey, k)
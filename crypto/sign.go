@@ -0,0 +1,111 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/random"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Schnorr signature
+type Signature struct {
+	R *Point
+	S *Scalar
+}
+
+// plain and blind signatures hash their challenges apart, so a blind
+// signature is never a plain signature on anything, and the other way
+var (
+	signDomain  = []byte("atom-schnorr")
+	blindDomain = []byte("atom-blind-schnorr")
+)
+
+// challenge for a schnorr signature on msg in domain
+func challenge(domain []byte, R kyber.Point, X kyber.Point, msg []byte) kyber.Scalar {
+	Rbin, _ := R.MarshalBinary()
+	Xbin, _ := X.MarshalBinary()
+	inp := append([]byte{}, domain...)
+	inp = append(inp, Rbin...)
+	inp = append(inp, Xbin...)
+	inp = append(inp, msg...)
+	cbin := sha3.Sum256(inp)
+	return SUITE.Scalar().SetBytes(cbin[:])
+}
+
+func Sign(priv *PrivateKey, msg []byte) *Signature {
+	k := SUITE.Scalar().Pick(random.New())
+	R := SUITE.Point().Mul(k, nil)
+	X := SUITE.Point().Mul(priv.s, nil)
+	c := challenge(signDomain, R, X, msg)
+	s := k.Add(k, c.Mul(c, priv.s))
+	return &Signature{
+		R: &Point{R},
+		S: &Scalar{s},
+	}
+}
+
+func Verify(pub *PublicKey, msg []byte, sig *Signature) error {
+	return verify(signDomain, pub, msg, sig)
+}
+
+// VerifyBlind checks a signature made with BlindSign
+func VerifyBlind(pub *PublicKey, msg []byte, sig *Signature) error {
+	return verify(blindDomain, pub, msg, sig)
+}
+
+func verify(domain []byte, pub *PublicKey, msg []byte, sig *Signature) error {
+	if sig == nil || sig.R == nil || sig.S == nil {
+		return errors.New("Missing signature")
+	}
+	c := challenge(domain, sig.R.p, pub.p, msg)
+	S := SUITE.Point().Mul(sig.S.s, nil)
+	R := SUITE.Point().Mul(c, pub.p)
+	R = R.Add(sig.R.p, R)
+	if !S.Equal(R) {
+		return errors.New("Signature verify failed")
+	}
+	return nil
+}
+
+// Hex encodes the signature as R followed by S
+func (sig *Signature) Hex() string {
+	Rbin, _ := sig.R.MarshalBinary()
+	Sbin, _ := sig.S.MarshalBinary()
+	return hex.EncodeToString(append(Rbin, Sbin...))
+}
+
+// text form, so signatures can be kept in JSON
+func (sig *Signature) MarshalText() ([]byte, error) {
+	return []byte(sig.Hex()), nil
+}
+
+func (sig *Signature) UnmarshalText(text []byte) error {
+	parsed, err := ParseSignature(string(text))
+	if err != nil {
+		return err
+	}
+	*sig = *parsed
+	return nil
+}
+
+func ParseSignature(sig string) (*Signature, error) {
+	b, err := hex.DecodeString(sig)
+	if err != nil {
+		return nil, err
+	}
+	plen := SUITE.Point().MarshalSize()
+	if len(b) != plen+SUITE.Scalar().MarshalSize() {
+		return nil, errors.New("Bad signature length")
+	}
+	R, S := new(Point), new(Scalar)
+	if err := R.UnmarshalBinary(b[:plen]); err != nil {
+		return nil, err
+	}
+	if err := S.UnmarshalBinary(b[plen:]); err != nil {
+		return nil, err
+	}
+	return &Signature{R, S}, nil
+}
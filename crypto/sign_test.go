@@ -0,0 +1,42 @@
+package crypto
+
+import "testing"
+
+func TestSign(t *testing.T) {
+	key := GenKey()
+	msg := []byte("atom")
+
+	sig := Sign(key.Priv, msg)
+	if err := Verify(key.Pub, msg, sig); err != nil {
+		t.Error(err)
+	}
+	if err := Verify(key.Pub, []byte("mota"), sig); err == nil {
+		t.Error("Signature verified for the wrong msg")
+	}
+	if err := Verify(GenKey().Pub, msg, sig); err == nil {
+		t.Error("Signature verified for the wrong key")
+	}
+}
+
+func TestBlindSign(t *testing.T) {
+	key := GenKey()
+	msg := []byte("token")
+
+	k, R := BlindCommit()
+	blinding, c := Blind(key.Pub, R, msg)
+	s := BlindSign(key.Priv, k, c)
+	sig := Unblind(blinding, s)
+
+	if err := VerifyBlind(key.Pub, msg, sig); err != nil {
+		t.Error(err)
+	}
+	if err := Verify(key.Pub, msg, sig); err == nil {
+		t.Error("Blind signature verified as a plain one")
+	}
+	if sig.R.Equal(R) {
+		t.Error("Signature is linkable to the signer's commitment")
+	}
+	if err := VerifyBlind(key.Pub, []byte("other"), sig); err == nil {
+		t.Error("Blind signature verified for the wrong msg")
+	}
+}
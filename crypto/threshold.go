@@ -3,7 +3,9 @@ package crypto
 import (
 	"errors"
 	"log"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/dedis/kyber"
 	dkg "github.com/dedis/kyber/share/dkg/pedersen"
@@ -20,9 +22,10 @@ type Threshold struct {
 	deals  map[int]*ThresholdDeal
 	secret *dkg.DistKeyShare
 
-	dealCnt  int       // channel to count number of deals received
-	respCnt  chan bool // channel to count number of deals received
-	dealCond *sync.Cond
+	dealCnt int  // number of deals received
+	respCnt int  // number of responses received
+	expired bool // the deadline of JVSSTimeout passed
+	cond    *sync.Cond
 }
 
 func NewThreshold(myIdx, T int, key *KeyPair, longPubs []*PublicKey) *Threshold {
@@ -58,25 +61,23 @@ func NewThreshold(myIdx, T int, key *KeyPair, longPubs []*PublicKey) *Threshold
 		keyGen: keyGen,
 		deals:  tdeals,
 
-		dealCnt:  0,
-		respCnt:  make(chan bool, N*N),
-		dealCond: sync.NewCond(new(sync.Mutex)),
+		dealCnt: 0,
+		respCnt: 0,
+		cond:    sync.NewCond(new(sync.Mutex)),
 	}
 
 	return t
 }
 
 func (t *Threshold) AddDeal(deal *ThresholdDeal) (*ThresholdResponse, error) {
-	t.dealCond.L.Lock()
-	defer t.dealCond.L.Unlock()
+	t.cond.L.Lock()
+	defer t.cond.L.Unlock()
 	resp, err := t.keyGen.ProcessDeal(deal.D)
 	if err != nil {
 		return nil, err
 	}
 	t.dealCnt += 1
-	if t.dealCnt == t.N-1 {
-		t.dealCond.Broadcast()
-	}
+	t.cond.Broadcast()
 	return &ThresholdResponse{resp}, nil
 }
 
@@ -85,9 +86,10 @@ func (t *Threshold) GetDeal(i int) *ThresholdDeal {
 }
 
 func (t *Threshold) AddResponse(resp *ThresholdResponse) error {
-	t.dealCond.L.Lock()
-	for t.dealCnt < t.N-1 {
-		t.dealCond.Wait()
+	t.cond.L.Lock()
+	defer t.cond.L.Unlock()
+	for t.dealCnt < t.N-1 && !t.expired {
+		t.cond.Wait()
 	}
 	just, err := t.keyGen.ProcessResponse(resp.R)
 	if just != nil {
@@ -95,16 +97,38 @@ func (t *Threshold) AddResponse(resp *ThresholdResponse) error {
 	} else if err != nil {
 		return err
 	}
-	t.dealCond.L.Unlock()
-	t.respCnt <- true
+	t.respCnt += 1
+	t.cond.Broadcast()
 	return nil
 }
 
 // Joint verifiable secret sharing setup
 func (t *Threshold) JVSS() error {
+	return t.JVSSTimeout(0)
+}
+
+// JVSSTimeout is JVSS, but once timeout passes without every deal and
+// response, it finishes with the participants whose deals were
+// certified, if there are at least the threshold of them; 0 waits
+// forever
+func (t *Threshold) JVSSTimeout(timeout time.Duration) error {
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, t.expire)
+		defer timer.Stop()
+	}
+
+	t.cond.L.Lock()
+	defer t.cond.L.Unlock()
 	// Wait until it receives enough resps
-	for i := 0; i < (t.N-1)*(t.N-1); i++ {
-		<-t.respCnt
+	for t.respCnt < (t.N-1)*(t.N-1) && !t.expired {
+		t.cond.Wait()
+	}
+	if t.respCnt < (t.N-1)*(t.N-1) {
+		// missing responses count as complaints from now on
+		t.keyGen.SetTimeout()
+		if !t.keyGen.Certified() {
+			return errors.New("Key generation timed out below the threshold")
+		}
 	}
 
 	var err error
@@ -116,26 +140,100 @@ func (t *Threshold) JVSS() error {
 	return nil
 }
 
+// expire stops waiting for deals and responses
+func (t *Threshold) expire() {
+	t.cond.L.Lock()
+	t.expired = true
+	t.cond.Broadcast()
+	t.cond.L.Unlock()
+}
+
+// QUAL returns the sorted participants whose deals make up the key
+func (t *Threshold) QUAL() []int {
+	t.cond.L.Lock()
+	defer t.cond.L.Unlock()
+	qual := append([]int{}, t.keyGen.QUAL()...)
+	sort.Ints(qual)
+	return qual
+}
+
 func (t *Threshold) PublicKey() *PublicKey {
 	return &t.groupKey
 }
 
-// Given threshold group in terms of the index within the group,
-// compute the lagrangian, and relevant point
-func (t *Threshold) Lagrange(group []int) *PrivateKey {
+// lagrange coefficient of idx for recovering the secret from the
+// shares of group, where index i holds the polynomial at 1+i
+func lagrange(idx int, group []int) kyber.Scalar {
 	numer := SUITE.Scalar().One()
 	denom := SUITE.Scalar().One()
-	xServer := SUITE.Scalar().SetInt64(1 + int64(t.myIdx))
+	xi := SUITE.Scalar().SetInt64(1 + int64(idx))
 	for i := range group {
-		if group[i] == t.myIdx {
+		if group[i] == idx {
 			continue
 		}
 		numer = numer.Mul(numer, SUITE.Scalar().SetInt64(1+int64(group[i])))
 		xj := SUITE.Scalar().SetInt64(1 + int64(group[i]))
-		xj = xj.Sub(xj, xServer)
+		xj = xj.Sub(xj, xi)
 		denom = denom.Mul(denom, xj)
 	}
-	numer = numer.Div(numer, denom)
-	key := SUITE.Scalar().Mul(numer, t.secret.Share.V)
+	return numer.Div(numer, denom)
+}
+
+// Given threshold group in terms of the index within the group,
+// compute the lagrangian, and relevant point
+func (t *Threshold) Lagrange(group []int) *PrivateKey {
+	coeff := lagrange(t.myIdx, group)
+	key := SUITE.Scalar().Mul(coeff, t.secret.Share.V)
 	return &PrivateKey{key}
 }
+
+// Share returns this participant's share of the secret as is, for
+// someone else to combine with CombineShares
+func (t *Threshold) Share() *PrivateKey {
+	return &PrivateKey{t.secret.Share.V.Clone()}
+}
+
+// Commits returns the public polynomial of the secret; the first
+// coefficient is the group key
+func (t *Threshold) Commits() []*PublicKey {
+	commits := make([]*PublicKey, len(t.secret.Commits))
+	for i, c := range t.secret.Commits {
+		commits[i] = &PublicKey{c.Clone()}
+	}
+	return commits
+}
+
+// PublicShare evaluates the public polynomial commits at idx, which
+// gives the public key of idx's share
+func PublicShare(commits []*PublicKey, idx int) *PublicKey {
+	x := SUITE.Scalar().SetInt64(1 + int64(idx))
+	xk := SUITE.Scalar().One()
+	v := SUITE.Point().Null()
+	for _, c := range commits {
+		v = v.Add(v, SUITE.Point().Mul(xk, c.p))
+		xk = xk.Mul(xk, x)
+	}
+	return &PublicKey{v}
+}
+
+// CombineShares recovers the secret from the shares of the indices in
+// group; any threshold many of them are enough
+func CombineShares(group []int, shares []*PrivateKey) *PrivateKey {
+	secret := SUITE.Scalar().Zero()
+	for i, idx := range group {
+		term := SUITE.Scalar().Mul(lagrange(idx, group), shares[i].s)
+		secret = secret.Add(secret, term)
+	}
+	return &PrivateKey{secret}
+}
+
+// CombinePartials recovers x*R from the partials x_i*R of the indices
+// in group, without anyone learning x
+func CombinePartials(group []int, partials []*Point) *Point {
+	res := SUITE.Point().Null()
+	for i, idx := range group {
+		term := SUITE.Point().Mul(lagrange(idx, group), partials[i].p)
+		res = res.Add(res, term)
+	}
+	return &Point{res}
+}
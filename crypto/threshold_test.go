@@ -3,6 +3,7 @@ package crypto
 import (
 	"log"
 	"testing"
+	"time"
 )
 
 var M int = 1
@@ -79,4 +80,42 @@ func TestThresholdSharing(t *testing.T) {
 			t.Error("Data corrupted!")
 		}
 	}
+
+	// any T shares recover the private key
+	group := []int{N - 1, 0, 2, 3}
+	shares := make([]*PrivateKey, len(group))
+	for i, idx := range group {
+		shares[i] = ts[idx].Share()
+	}
+	if !PubFromPriv(CombineShares(group, shares)).Equal(groupKey) {
+		t.Error("Shares did not recover the group key")
+	}
+
+	// and open CCA2 ciphertexts from checked partial decryptions
+	plaintext := []byte("partial")
+	nonce := []byte("nonce")
+	inner := CCA2Encrypt(plaintext, nonce, groupKey)
+	commits := ts[0].Commits()
+	partials := make([]*Point, len(group))
+	for i, idx := range group {
+		var proof DLEQProof
+		partials[i], proof = ProveDLEQ(ts[idx].Share(), inner.R)
+		err := VerifyDLEQ(PublicShare(commits, idx), inner.R, partials[i], proof)
+		if err != nil {
+			t.Error("Partial decryption did not verify:", err)
+		}
+	}
+	shared := CombinePartials(group, partials)
+	res, err := CCA2DecryptShared(inner, nonce, shared, groupKey)
+	if err != nil || string(res) != string(plaintext) {
+		t.Error("Partial decryptions did not open the ciphertext")
+	}
+}
+
+func TestThresholdTimeout(t *testing.T) {
+	keys, pubs, _ := GenKeys(N)
+	ts := NewThreshold(0, T, keys[0], pubs)
+	if err := ts.JVSSTimeout(10 * time.Millisecond); err == nil {
+		t.Error("Made a key without any deals")
+	}
 }
@@ -27,8 +27,15 @@ type entry struct {
 	msgs      [][]byte
 }
 
-func NewDB(port int) (*DB, error) {
-	_, tlsConfig := atomrpc.AtomTLSConfig()
+// NewDB listens with tlsCert, which the servers and clients pin, or a
+// fresh certificate if it is nil
+func NewDB(port int, tlsCert *tls.Certificate) (*DB, error) {
+	var tlsConfig *tls.Config
+	if tlsCert == nil {
+		_, tlsConfig = atomrpc.AtomTLSConfig()
+	} else {
+		tlsConfig = atomrpc.TLSConfig(*tlsCert)
+	}
 
 	l, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), tlsConfig)
 	if err != nil {
@@ -8,7 +8,7 @@ import (
 )
 
 func TestDB(t *testing.T) {
-	db, err := NewDB(10001)
+	db, err := NewDB(10001, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -0,0 +1,232 @@
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "github.com/kwonalbert/atom/common"
+	. "github.com/kwonalbert/atom/crypto"
+)
+
+// Config describes a deployment. The directory loads it from a JSON
+// file, e.g.
+//
+//	{"Mode": 1, "NetType": 1, "NumServers": 16, "NumGroups": 4,
+//	 "PerGroup": 4, "NumTrustees": 4, "NumClients": 16, "NumMsgs": 16,
+//	 "MsgSize": 160, "NumLevels": 10, "Threshold": 3}
+//
+// and publishes it as is.
+type Config struct {
+	// NumLevels 0 picks the default for the network type, Threshold
+	// 0 tolerates one faulty member per group (PerGroup-1, at least
+	// 1), and TrusteeThreshold 0 requires every trustee.
+	// A round's key is made by a qualified set of at least
+	// TrusteeThreshold trustees, and opening the round needs any
+	// TrusteeThreshold of them.
+	SystemParameter
+
+	// approved server, trustee and client public keys; nil accepts
+	// any key, except for clients when submissions need tokens
+	ServerKeys  []string
+	TrusteeKeys []string
+	ClientKeys  []string
+
+	// public key of each directory, by id. They are fixed before any
+	// epoch, so no directory can pick its beacon key once it knows
+	// the beacon inputs; nil lets every directory make its own.
+	DirectoryKeys []string
+
+	// number of directories; 0 means as many as DirectoryKeys, or one
+	// without them
+	NumDirs int `json:",omitempty"`
+
+	// start of round 0 of the round schedule, in RFC3339. With more
+	// than one directory it has to be given, so they all agree;
+	// otherwise zero picks the next multiple of the period.
+	RoundStart time.Time
+
+	// files written by keygen to read the keys above from instead,
+	// relative to the config file
+	ServerKeyFile  string `json:",omitempty"`
+	TrusteeKeyFile string `json:",omitempty"`
+	ClientKeyFile  string `json:",omitempty"`
+
+	DirectoryKeyFile string `json:",omitempty"`
+}
+
+// levels a butterfly needs to mix fully; square networks default to 10
+func (c *Config) levels() int {
+	if c.NumLevels != 0 {
+		return c.NumLevels
+	} else if c.NetType == BUTTERFLY {
+		return Log2(c.NumGroups) * Log2(c.NumGroups)
+	}
+	return 10
+}
+
+// params fills in the defaults
+func (c *Config) params() SystemParameter {
+	p := c.SystemParameter
+	p.NumLevels = c.levels()
+	if p.Threshold == 0 {
+		p.Threshold = p.PerGroup - 1
+		if p.Threshold < 1 {
+			p.Threshold = 1
+		}
+	}
+	if p.TrusteeThreshold == 0 {
+		p.TrusteeThreshold = p.NumTrustees
+	}
+	return p
+}
+
+// numDirs is how many directories the deployment has
+func (c *Config) numDirs() int {
+	if c.NumDirs != 0 {
+		return c.NumDirs
+	} else if c.DirectoryKeys != nil {
+		return len(c.DirectoryKeys)
+	}
+	return 1
+}
+
+// conflicts checks p, the parameters a directory restored from its
+// store, and dirKeys, the directory keys it committed to, against the
+// config; only the number of servers may differ, since it changes
+// with the epochs
+func (c *Config) conflicts(p SystemParameter, dirKeys []string) error {
+	want := c.params()
+	want.NumServers = p.NumServers
+	if want != p {
+		return fmt.Errorf("Config %+v conflicts with the stored parameters %+v",
+			want, p)
+	}
+	if !equalStrings(c.DirectoryKeys, dirKeys) {
+		return errors.New("Config conflicts with the stored directory keys")
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if c.Mode != VER_MODE && c.Mode != TRAP_MODE {
+		return fmt.Errorf("Unknown mode %d", c.Mode)
+	}
+	if c.NetType != BUTTERFLY && c.NetType != SQUARE {
+		return fmt.Errorf("Unknown network type %d", c.NetType)
+	}
+	if c.NumGroups < 1 || c.PerGroup < 1 {
+		return errors.New("Need at least one group of one server")
+	}
+	if c.NetType == BUTTERFLY && c.NumGroups&(c.NumGroups-1) != 0 {
+		return errors.New("Butterfly networks need a power of two groups")
+	}
+	// with no servers, they all join at the next epoch
+	if c.NumServers < 0 || c.NumServers > MAX_SERVERS ||
+		(c.NumServers != 0 && c.NumServers < c.PerGroup) {
+		return fmt.Errorf("Can't make groups of %d from %d servers",
+			c.PerGroup, c.NumServers)
+	}
+	if c.NumLevels < 0 || c.levels() < 1 {
+		return errors.New("Need at least one level")
+	}
+	if c.Mode == TRAP_MODE && c.NumTrustees < 1 {
+		return errors.New("Trap mode needs trustees")
+	} else if c.NumTrustees < 0 {
+		return errors.New("Negative number of trustees")
+	}
+	if c.NumClients < 1 {
+		return errors.New("Need at least one client")
+	}
+	if c.NumMsgs < 1 || c.MsgSize < 1 {
+		return errors.New("Need at least one message of one byte")
+	}
+	if c.Threshold < 0 || c.Threshold > c.PerGroup {
+		return fmt.Errorf("Threshold %d out of range for groups of %d",
+			c.Threshold, c.PerGroup)
+	}
+	if c.TrusteeThreshold < 0 || c.TrusteeThreshold > c.NumTrustees {
+		return fmt.Errorf("Trustee threshold %d out of range for %d trustees",
+			c.TrusteeThreshold, c.NumTrustees)
+	}
+	if c.NumDirs < 0 || (c.NumDirs != 0 && c.DirectoryKeys != nil &&
+		c.NumDirs != len(c.DirectoryKeys)) {
+		return fmt.Errorf("%d directories with %d committed keys",
+			c.NumDirs, len(c.DirectoryKeys))
+	}
+	// otherwise anyone can register as many clients as they want
+	if c.Auth && c.ClientKeys == nil {
+		return errors.New("Tokens need approved client keys")
+	}
+	for _, keys := range [][]string{c.ServerKeys, c.TrusteeKeys, c.ClientKeys,
+		c.DirectoryKeys} {
+		for _, key := range keys {
+			_, err := ParsePubKey(key)
+			if err != nil {
+				return fmt.Errorf("Bad key %q: %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// path of fn, relative to the directory of base unless absolute
+func relativeTo(base, fn string) string {
+	if filepath.IsAbs(fn) {
+		return fn
+	}
+	return filepath.Join(filepath.Dir(base), fn)
+}
+
+func LoadConfig(fn string) (*Config, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ServerKeyFile != "" {
+		config.ServerKeys, err = ReadPubKeys(relativeTo(fn, config.ServerKeyFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.TrusteeKeyFile != "" {
+		config.TrusteeKeys, err = ReadPubKeys(relativeTo(fn, config.TrusteeKeyFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.ClientKeyFile != "" {
+		config.ClientKeys, err = ReadPubKeys(relativeTo(fn, config.ClientKeyFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.DirectoryKeyFile != "" {
+		config.DirectoryKeys, err = ReadPubKeys(relativeTo(fn, config.DirectoryKeyFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Config returns the configuration the directory was started with
+func (d *DirectoryRPC) Config(_ *int, config *Config) error {
+	*config = *d.d.config
+	return nil
+}
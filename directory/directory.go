@@ -1,39 +1,78 @@
 package directory
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/rpc"
+	"sort"
 	"sync"
 	"time"
 
 	. "github.com/kwonalbert/atom/atomrpc"
 	. "github.com/kwonalbert/atom/common"
+	. "github.com/kwonalbert/atom/crypto"
+
+	"golang.org/x/crypto/sha3"
 )
 
 type Directory struct {
 	id   int
 	port int
 
-	// used to wait for server+trustee reg
-	wg   *sync.WaitGroup
-	done *sync.WaitGroup
-
-	// used to wait for group reg
-	gwg   *sync.WaitGroup
-	gdone *sync.WaitGroup
-
-	listener net.Listener
+	listener     net.Listener
+	httpListener net.Listener // read-only JSON view, if served
 
 	tlsCert   *tls.Certificate
 	tlsConfig *tls.Config
 
+	keyPair  *KeyPair // long-term key, signs the directory
+	tokenKey *KeyPair // blindly signs tokens, and nothing else
+
+	storePath string // where the state is persisted, if anywhere
+
+	// all directories, to compute the group layout for the JSON view
+	peers   []string
+	pool    *ConnPool
+	layouts *layoutCache
+
+	config *Config // as loaded, published to anyone who asks
+
+	// operator approved server, trustee and client keys; nil accepts
+	// any key
+	serverKeys  map[string]bool
+	trusteeKeys map[string]bool
+	clientKeys  map[string]bool
+
+	// registration and epoch state
+	lock      *sync.Mutex
+	cond      *sync.Cond
+	frozen    bool                          // the first epoch is frozen
+	joins     map[int]*Registration         // servers joining at the next epoch
+	leaves    map[int]bool                  // servers leaving at the next epoch
+	roundRegs map[int]map[int]*Registration // round to trustee to round key
+
+	version int // bumped on every change
+
+	// anonymous submission tokens, also guarded by lock
+	clients  map[int]*PublicKey  // registered client keys
+	issued   map[int]map[int]int // round to client to # of tokens
+	session  *tokenSession       // the open signing session, if any
+	sessions chan bool           // full while a session is open
+
+	verdicts map[int]map[int]*Verdict // round to trustee to verdict
+
 	// Exported fields; represents a logical directory
 	SystemParameter
-	Round int
+	Epoch    int
+	Round    int
+	Schedule Schedule // when rounds take submissions
 
+	// indexed by server id; an empty key means the id is not in use
 	Servers      []string
 	Keys         []string
 	Certificates [][][]byte
@@ -44,6 +83,58 @@ type Directory struct {
 
 	GroupKeys [][]string     // uid to group key
 	RoundKeys map[int]string // round to per round key
+
+	// round to the public polynomial of the round key, which gives
+	// each trustee's public share
+	RoundCommits map[int][]string
+
+	// round to the trustees whose deals made the round key
+	RoundQuals map[int][]int
+
+	// the directories' keys as committed in the config, if they are
+	DirectoryKeys []string
+
+	Sig *Signature // this directory's signature on Digest()
+}
+
+// largest server id, so a registration can't make the directory
+// allocate arbitrarily large tables
+const MAX_SERVERS = 1 << 16
+
+const (
+	REGISTERING  = 0 // waiting for the first epoch's servers and trustees
+	KEYS_PENDING = 1 // waiting for the group and round keys of the epoch
+	READY        = 2
+)
+
+// longest a directory call waits for a change
+const MAX_POLL = time.Minute
+
+// Asks for the directory. With a Timeout, the call first waits until
+// the directory changes from Version or the timeout passes, so callers
+// can long-poll instead of retrying.
+type DirectoryArgs struct {
+	Version int
+	Timeout time.Duration
+}
+
+type DirectoryReply struct {
+	Status    int
+	Version   int
+	Directory *Directory // nil until the directory reaches the status asked for
+}
+
+// WaitArgs asks to wait for the epoch or round after After, for at
+// most Timeout (capped at MAX_POLL)
+type WaitArgs struct {
+	After   int
+	Timeout time.Duration
+}
+
+type EpochReply struct {
+	Epoch   int // the new epoch, -1 if the wait expired first
+	Status  int
+	Version int
 }
 
 type DirectoryRPC struct {
@@ -51,62 +142,742 @@ type DirectoryRPC struct {
 }
 
 type Registration struct {
+	Epoch       int
 	Round       int
 	Addr        string
 	Level       int // only relevant for group registration
+	Member      int // the server registering a group key
 	Id          int
 	Key         string
 	Certificate [][]byte
+	Commits     []string // public polynomial, for round key registrations
+	Qual        []int    // trustees whose deals made a round key
+
+	Sig *Signature // by Key, so only its owner can register it
+}
+
+func (r *Registration) message() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(r.Epoch))
+	binary.Write(buf, binary.LittleEndian, uint32(r.Round))
+	binary.Write(buf, binary.LittleEndian, uint32(r.Level))
+	binary.Write(buf, binary.LittleEndian, uint32(r.Member))
+	binary.Write(buf, binary.LittleEndian, uint32(r.Id))
+	binary.Write(buf, binary.LittleEndian, uint32(len(r.Qual)))
+	for _, q := range r.Qual {
+		binary.Write(buf, binary.LittleEndian, uint32(q))
+	}
+	fields := append([][]byte{[]byte(r.Addr), []byte(r.Key)}, r.Certificate...)
+	for _, c := range r.Commits {
+		fields = append(fields, []byte(c))
+	}
+	for _, f := range fields {
+		binary.Write(buf, binary.LittleEndian, uint32(len(f)))
+		buf.Write(f)
+	}
+	return buf.Bytes()
+}
+
+func (r *Registration) Sign(priv *PrivateKey) {
+	r.Sig = Sign(priv, r.message())
+}
+
+// a leave is signed separately, so a registration can't be replayed
+// as one
+func (r *Registration) leaveMessage() []byte {
+	return append([]byte("leave"), r.message()...)
+}
+
+func (r *Registration) SignLeave(priv *PrivateKey) {
+	r.Sig = Sign(priv, r.leaveMessage())
+}
+
+// a round key is signed by the trustee's long-term key rather than by
+// Key, and separately so no other registration can be replayed as one
+func (r *Registration) roundMessage() []byte {
+	return append([]byte("round"), r.message()...)
+}
+
+func (r *Registration) SignRound(priv *PrivateKey) {
+	r.Sig = Sign(priv, r.roundMessage())
+}
+
+// a group key is signed by the long-term key of the member registering
+// it, and separately so no other registration can be replayed as one
+func (r *Registration) groupMessage() []byte {
+	return append([]byte("group"), r.message()...)
+}
+
+func (r *Registration) SignGroup(priv *PrivateKey) {
+	r.Sig = Sign(priv, r.groupMessage())
+}
+
+// check that reg is signed by its key and the key is approved
+func checkRegistration(reg *Registration, approved map[string]bool,
+	msg []byte) error {
+	pub, err := ParsePubKey(reg.Key)
+	if err != nil {
+		return err
+	}
+	err = Verify(pub, msg, reg.Sig)
+	if err != nil {
+		return err
+	}
+	if approved != nil && !approved[reg.Key] {
+		return errors.New("Key not approved")
+	}
+	return nil
+}
+
+// check neither the id nor the key of reg is taken in keys
+func checkTaken(reg *Registration, keys []string) error {
+	if reg.Id < len(keys) && keys[reg.Id] != "" {
+		return errors.New("Id already registered")
+	}
+	for _, key := range keys {
+		if key == reg.Key {
+			return errors.New("Key already registered")
+		}
+	}
+	return nil
+}
+
+// the first epoch is frozen once every expected server and trustee
+// has registered
+func (d *Directory) checkFrozen() {
+	if d.frozen {
+		return
+	}
+	for _, keys := range [][]string{d.Keys, d.TrusteeKeys} {
+		for _, key := range keys {
+			if key == "" {
+				return
+			}
+		}
+	}
+	d.frozen = true
+}
+
+// all group keys of the epoch and the trustees' round key are in
+func (d *Directory) keysReady() bool {
+	if !d.frozen || (d.NumTrustees > 0 && d.RoundKeys[d.Round] == "") {
+		return false
+	}
+	for level := range d.GroupKeys {
+		for _, key := range d.GroupKeys[level] {
+			if key == "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func newGroupKeys(numLevels, numGroups int) [][]string {
+	keys := make([][]string, numLevels)
+	for level := range keys {
+		keys[level] = make([]string, numGroups)
+	}
+	return keys
+}
+
+// NextEpoch freezes the servers that joined or left since the last
+// epoch into a new directory. Every group of the new epoch has to
+// register its key again. Epochs should only change between rounds,
+// see NextEpochBetweenRounds.
+func (d *Directory) NextEpoch() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.nextEpoch()
+}
+
+// NextEpochBetweenRounds waits until no round is underway, and then
+// moves to the next epoch
+func (d *Directory) NextEpochBetweenRounds() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for d.roundRunning(time.Now()) {
+		// verdicts do not bump the version, so check every so often
+		d.waitChange(d.version, time.Second)
+	}
+	return d.nextEpoch()
+}
+
+// requires lock
+func (d *Directory) nextEpoch() error {
+	if !d.frozen {
+		return errors.New("First epoch is not frozen yet")
+	}
+
+	numServers := len(d.Servers)
+	for id := range d.joins {
+		if id >= numServers {
+			numServers = id + 1
+		}
+	}
+
+	// copy, since older snapshots may still be in flight
+	servers := make([]string, numServers)
+	keys := make([]string, numServers)
+	certs := make([][][]byte, numServers)
+	copy(servers, d.Servers)
+	copy(keys, d.Keys)
+	copy(certs, d.Certificates)
+	for id := range d.leaves {
+		servers[id], keys[id], certs[id] = "", "", nil
+	}
+	for id, reg := range d.joins {
+		servers[id], keys[id], certs[id] = reg.Addr, reg.Key, reg.Certificate
+	}
+
+	active := 0
+	for _, key := range keys {
+		if key != "" {
+			active++
+		}
+	}
+	if active < d.PerGroup {
+		return fmt.Errorf("Only %d servers for groups of %d", active, d.PerGroup)
+	}
+
+	d.Servers, d.Keys, d.Certificates = servers, keys, certs
+	d.NumServers = numServers
+	d.GroupKeys = newGroupKeys(d.NumLevels, d.NumGroups)
+	d.joins = make(map[int]*Registration)
+	d.leaves = make(map[int]bool)
+	d.Epoch++
+	d.changed()
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func allowlist(keys []string) map[string]bool {
+	if keys == nil {
+		return nil
+	}
+	approved := make(map[string]bool)
+	for _, key := range keys {
+		approved[key] = true
+	}
+	return approved
+}
+
+// Digest is a canonical hash of everything the directories have to
+// agree on, i.e. all exported fields except the signature. Every value
+// is length-prefixed, so it survives gob, which turns empty slices and
+// maps into nil.
+func (d *Directory) Digest() []byte {
+	w := &digestWriter{new(bytes.Buffer)}
+	p := d.SystemParameter
+	w.ints(p.Mode, p.NetType, p.NumServers, p.NumGroups, p.PerGroup,
+		p.NumTrustees, p.NumLevels, p.NumClients, p.NumMsgs, p.MsgSize,
+		p.Threshold, p.TrusteeThreshold)
+	w.bool(p.Auth)
+	w.ints(d.Epoch, d.Round)
+	w.bool(d.Schedule.Start.IsZero())
+	if !d.Schedule.Start.IsZero() {
+		w.ints(int(d.Schedule.Start.Unix()), d.Schedule.Start.Nanosecond())
+	}
+	w.ints(int(d.Schedule.Period), int(d.Schedule.Window))
+
+	w.strings(d.Servers)
+	w.strings(d.Keys)
+	w.certs(d.Certificates)
+	w.strings(d.Trustees)
+	w.strings(d.TrusteeKeys)
+	w.certs(d.TrusteeCerts)
+
+	w.ints(len(d.GroupKeys))
+	for _, keys := range d.GroupKeys {
+		w.strings(keys)
+	}
+	rounds := make([]int, 0, len(d.RoundKeys))
+	for round := range d.RoundKeys {
+		rounds = append(rounds, round)
+	}
+	sort.Ints(rounds)
+	w.ints(len(rounds))
+	for _, round := range rounds {
+		w.ints(round)
+		w.bytes([]byte(d.RoundKeys[round]))
+	}
+	rounds = rounds[:0]
+	for round := range d.RoundCommits {
+		rounds = append(rounds, round)
+	}
+	sort.Ints(rounds)
+	w.ints(len(rounds))
+	for _, round := range rounds {
+		w.ints(round)
+		w.strings(d.RoundCommits[round])
+	}
+	rounds = rounds[:0]
+	for round := range d.RoundQuals {
+		rounds = append(rounds, round)
+	}
+	sort.Ints(rounds)
+	w.ints(len(rounds))
+	for _, round := range rounds {
+		w.ints(round, len(d.RoundQuals[round]))
+		w.ints(d.RoundQuals[round]...)
+	}
+	w.strings(d.DirectoryKeys)
+
+	h := sha3.Sum256(w.buf.Bytes())
+	return h[:]
+}
+
+// digestWriter writes the encoding Digest hashes
+type digestWriter struct {
+	buf *bytes.Buffer
+}
+
+func (w *digestWriter) ints(vs ...int) {
+	for _, v := range vs {
+		binary.Write(w.buf, binary.LittleEndian, int64(v))
+	}
+}
+
+func (w *digestWriter) bool(v bool) {
+	binary.Write(w.buf, binary.LittleEndian, v)
+}
+
+func (w *digestWriter) bytes(b []byte) {
+	w.ints(len(b))
+	w.buf.Write(b)
+}
+
+func (w *digestWriter) strings(ss []string) {
+	w.ints(len(ss))
+	for _, s := range ss {
+		w.bytes([]byte(s))
+	}
+}
+
+// certificate chains, by id
+func (w *digestWriter) certs(certs [][][]byte) {
+	w.ints(len(certs))
+	for _, chain := range certs {
+		w.ints(len(chain))
+		for _, cert := range chain {
+			w.bytes(cert)
+		}
+	}
+}
+
+// a signed copy of the directory; the group and round keys are only
+// included once they are all registered, since they arrive at the
+// directories at different times
+func (d *Directory) snapshot(withKeys bool) Directory {
+	dir := *d
+	// the tables change in place, and the reply is encoded after the
+	// lock is released
+	dir.Servers = append([]string{}, d.Servers...)
+	dir.Keys = append([]string{}, d.Keys...)
+	dir.Certificates = append([][][]byte{}, d.Certificates...)
+	dir.Trustees = append([]string{}, d.Trustees...)
+	dir.TrusteeKeys = append([]string{}, d.TrusteeKeys...)
+	dir.TrusteeCerts = append([][][]byte{}, d.TrusteeCerts...)
+	if !withKeys {
+		dir.GroupKeys = nil
+		dir.RoundKeys = nil
+		dir.RoundCommits = nil
+		dir.RoundQuals = nil
+	} else {
+		dir.GroupKeys = make([][]string, len(d.GroupKeys))
+		for level := range d.GroupKeys {
+			dir.GroupKeys[level] = append([]string{}, d.GroupKeys[level]...)
+		}
+		dir.RoundKeys = make(map[int]string)
+		for round, key := range d.RoundKeys {
+			dir.RoundKeys[round] = key
+		}
+		dir.RoundCommits = make(map[int][]string)
+		for round, commits := range d.RoundCommits {
+			dir.RoundCommits[round] = commits
+		}
+		dir.RoundQuals = make(map[int][]int)
+		for round, qual := range d.RoundQuals {
+			dir.RoundQuals[round] = qual
+		}
+	}
+	dir.Sig = Sign(d.keyPair.Priv, dir.Digest())
+	return dir
 }
 
-func (d *DirectoryRPC) Directory(_ *int, dir *Directory) error {
-	d.d.wg.Wait()
-	*dir = *(d.d)
-	d.d.done.Done()
+// changed records a change to the directory: it gets a new version,
+// is saved, and waiting calls wake up. The caller holds d.lock.
+func (d *Directory) changed() {
+	d.version++
+	d.save()
+	d.cond.Broadcast()
+}
+
+func (d *Directory) status() int {
+	if !d.frozen {
+		return REGISTERING
+	} else if !d.keysReady() {
+		return KEYS_PENDING
+	}
+	return READY
+}
+
+// waitChange waits until the directory moves past version or timeout
+// passes; the caller holds d.lock
+func (d *Directory) waitChange(version int, timeout time.Duration) {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		d.lock.Lock()
+		expired = true
+		d.cond.Broadcast()
+		d.lock.Unlock()
+	})
+	defer timer.Stop()
+	for !expired && d.version == version {
+		d.cond.Wait()
+	}
+}
+
+// pollTimeout caps how long a call waits, so callers get an answer
+// before their connection gives up on them
+func pollTimeout(timeout time.Duration) time.Duration {
+	if timeout > MAX_POLL {
+		return MAX_POLL
+	}
+	return timeout
+}
+
+// reply fills in the status, and a snapshot once the directory has
+// reached status need
+func (d *Directory) reply(args *DirectoryArgs, reply *DirectoryReply,
+	need int, withKeys bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if args.Timeout > 0 {
+		d.waitChange(args.Version, pollTimeout(args.Timeout))
+	}
+
+	reply.Status = d.status()
+	reply.Version = d.version
+	if reply.Status >= need {
+		dir := d.snapshot(withKeys)
+		reply.Directory = &dir
+	}
+}
+
+// Directory returns the servers and trustees once the first epoch is
+// frozen
+func (d *DirectoryRPC) Directory(args *DirectoryArgs, reply *DirectoryReply) error {
+	d.d.reply(args, reply, KEYS_PENDING, false)
+	return nil
+}
+
+// DirectoryWithGroupKeys returns the directory once every group and
+// round key of the epoch is in
+func (d *DirectoryRPC) DirectoryWithGroupKeys(args *DirectoryArgs, reply *DirectoryReply) error {
+	d.d.reply(args, reply, READY, true)
 	return nil
 }
 
-func (d *DirectoryRPC) DirectoryWithGroupKeys(_ *int, dir *Directory) error {
-	d.d.gwg.Wait()
-	*dir = *(d.d)
-	d.d.gdone.Done()
+// Epoch returns the current epoch
+func (d *DirectoryRPC) Epoch(_ *int, epoch *int) error {
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	*epoch = d.d.Epoch
 	return nil
 }
 
+// WaitEpoch blocks until the directory is past epoch args.After, or
+// the timeout expires, and returns the new epoch along with the
+// current status and version
+func (d *DirectoryRPC) WaitEpoch(args *WaitArgs, reply *EpochReply) error {
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	deadline := time.Now().Add(pollTimeout(args.Timeout))
+	reply.Epoch = -1
+	for {
+		if d.d.frozen && d.d.Epoch > args.After {
+			reply.Epoch = d.d.Epoch
+			break
+		}
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			break
+		}
+		d.d.waitChange(d.d.version, wait)
+	}
+	reply.Status = d.d.status()
+	reply.Version = d.d.version
+	return nil
+}
+
+// Register a server. Servers registering after the first epoch is
+// frozen join at the next epoch.
 func (d *DirectoryRPC) Register(reg *Registration, _ *int) error {
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	if reg.Id < 0 || reg.Id >= MAX_SERVERS {
+		return errors.New("Invalid registration id")
+	}
+	err := checkRegistration(reg, d.d.serverKeys, reg.message())
+	if err != nil {
+		return err
+	}
+	// or a server that left could be joined again with its old one
+	if reg.Epoch != d.d.Epoch {
+		return errors.New("Registration for a different epoch")
+	}
+	err = checkTaken(reg, d.d.Keys)
+	if err != nil {
+		return err
+	}
+	for id, join := range d.d.joins {
+		if id == reg.Id || join.Key == reg.Key {
+			return errors.New("Already joining")
+		}
+	}
+
+	if d.d.frozen || reg.Id >= len(d.d.Keys) {
+		d.d.joins[reg.Id] = reg
+		d.d.changed()
+		return nil
+	}
 	d.d.Servers[reg.Id] = reg.Addr
 	d.d.Keys[reg.Id] = reg.Key
 	d.d.Certificates[reg.Id] = reg.Certificate
-	d.d.wg.Done()
+	d.d.checkFrozen()
+	d.d.changed()
+	return nil
+}
+
+// Leave removes a server at the next epoch. The leave must be signed
+// for the current epoch, so an old one can't be replayed.
+func (d *DirectoryRPC) Leave(reg *Registration, _ *int) error {
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	err := checkRegistration(reg, nil, reg.leaveMessage())
+	if err != nil {
+		return err
+	}
+	if reg.Epoch != d.d.Epoch {
+		return errors.New("Leave for a different epoch")
+	}
+	if join, ok := d.d.joins[reg.Id]; ok && join.Key == reg.Key {
+		delete(d.d.joins, reg.Id)
+		d.d.changed()
+		return nil
+	}
+	if reg.Id < 0 || reg.Id >= len(d.d.Keys) || d.d.Keys[reg.Id] != reg.Key {
+		return errors.New("Server not registered")
+	}
+	d.d.leaves[reg.Id] = true
+	d.d.changed()
 	return nil
 }
 
+// RegisterGroup takes the key of a group, signed by the epoch's key of
+// the member that registers it, which is the group's first member
+// whenever this directory can work out the layout
 func (d *DirectoryRPC) RegisterGroup(reg *Registration, _ *int) error {
+	d.d.lock.Lock()
+	frozen := d.d.frozen
+	dir := d.d.layoutInput()
+	d.d.lock.Unlock()
+	// outside the lock, since it may ask the other directories
+	var groups [][]*Group
+	if frozen && d.d.canLayout() {
+		var err error
+		groups, err = d.d.layout(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	if !d.d.frozen || reg.Epoch != d.d.Epoch || reg.Epoch != dir.Epoch {
+		return errors.New("Group key for a different epoch")
+	}
+	if reg.Level < 0 || reg.Level >= len(d.d.GroupKeys) ||
+		reg.Id < 0 || reg.Id >= len(d.d.GroupKeys[reg.Level]) {
+		return errors.New("Invalid group")
+	}
+	if reg.Member < 0 || reg.Member >= len(d.d.Keys) || d.d.Keys[reg.Member] == "" {
+		return errors.New("Invalid group member")
+	}
+	if groups != nil && groups[reg.Level][reg.Id].Members[0] != reg.Member {
+		return errors.New("Not the group's first member")
+	}
+	// the server keys were approved when they registered
+	pub, err := ParsePubKey(d.d.Keys[reg.Member])
+	if err != nil {
+		return err
+	}
+	err = Verify(pub, reg.groupMessage(), reg.Sig)
+	if err != nil {
+		return err
+	}
+	key := d.d.GroupKeys[reg.Level][reg.Id]
+	if key != "" && key != reg.Key {
+		return errors.New("Mismatching group key registration")
+	}
 	d.d.GroupKeys[reg.Level][reg.Id] = reg.Key
-	d.d.gwg.Done()
+	d.d.changed()
 	return nil
 }
 
+// RegisterRound takes a trustee's share in the key of a round. The key
+// is only published once every trustee in its qualified set, which has
+// to be at least TrusteeThreshold trustees, has registered the same
+// key, commitments and set.
 func (d *DirectoryRPC) RegisterRound(reg *Registration, _ *int) error {
-	d.d.gwg.Done()
-	if key, ok := d.d.RoundKeys[reg.Round]; !ok {
-		d.d.RoundKeys[reg.Round] = reg.Key
-		return nil
-	} else {
-		if key != reg.Key {
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	if !d.d.frozen {
+		return errors.New("Trustees are not fixed yet")
+	}
+	if reg.Id < 0 || reg.Id >= len(d.d.TrusteeKeys) {
+		return errors.New("Invalid registration id")
+	}
+	pub, err := ParsePubKey(d.d.TrusteeKeys[reg.Id])
+	if err != nil {
+		return err
+	}
+	err = Verify(pub, reg.roundMessage(), reg.Sig)
+	if err != nil {
+		return err
+	}
+	if len(reg.Commits) == 0 || reg.Commits[0] != reg.Key {
+		return errors.New("Round key does not match its commitments")
+	}
+	err = d.d.checkQual(reg.Qual)
+	if err != nil {
+		return err
+	}
+
+	regs, ok := d.d.roundRegs[reg.Round]
+	if !ok {
+		regs = make(map[int]*Registration)
+		d.d.roundRegs[reg.Round] = regs
+	}
+	for _, other := range regs {
+		if other.Key != reg.Key || !equalStrings(other.Commits, reg.Commits) ||
+			!equalInts(other.Qual, reg.Qual) {
 			return errors.New("Mismatching round key registration")
-		} else {
-			return nil
 		}
 	}
+	if _, ok := regs[reg.Id]; ok {
+		return nil
+	}
+	cp := *reg
+	cp.Sig = nil
+	regs[reg.Id] = &cp
+	complete := true
+	for _, q := range reg.Qual {
+		if _, ok := regs[q]; !ok {
+			complete = false
+		}
+	}
+	if complete {
+		d.d.RoundKeys[reg.Round] = reg.Key
+		d.d.RoundCommits[reg.Round] = reg.Commits
+		d.d.RoundQuals[reg.Round] = reg.Qual
+	}
+	d.d.changed()
+	return nil
+}
+
+// check qual is a sorted set of at least TrusteeThreshold trustees
+func (d *Directory) checkQual(qual []int) error {
+	if len(qual) < d.TrusteeThreshold {
+		return errors.New("Qualified set is below the trustee threshold")
+	}
+	for i, q := range qual {
+		if q < 0 || q >= len(d.TrusteeKeys) || (i > 0 && q <= qual[i-1]) {
+			return errors.New("Invalid qualified set")
+		}
+	}
+	return nil
 }
 
+// The trustees are fixed once the first epoch is frozen
 func (d *DirectoryRPC) RegisterTrustee(reg *Registration, _ *int) error {
-	// TODO: Authenticate client somehow..
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	if d.d.frozen {
+		return errors.New("Trustees are already fixed")
+	}
+	if reg.Id < 0 || reg.Id >= len(d.d.TrusteeKeys) {
+		return errors.New("Invalid registration id")
+	}
+	err := checkRegistration(reg, d.d.trusteeKeys, reg.message())
+	if err != nil {
+		return err
+	}
+	err = checkTaken(reg, d.d.TrusteeKeys)
+	if err != nil {
+		return err
+	}
 	d.d.Trustees[reg.Id] = reg.Addr
 	d.d.TrusteeKeys[reg.Id] = reg.Key
 	d.d.TrusteeCerts[reg.Id] = reg.Certificate
-	d.d.wg.Done()
+	d.d.checkFrozen()
+	d.d.changed()
+	return nil
+}
+
+// a round's key and the public polynomial behind it
+type RoundKeyReply struct {
+	Key     string
+	Commits []string
+	Qual    []int
+}
+
+// RoundKey returns the key of round, waiting up to MAX_POLL for the
+// trustees to register it
+func (d *DirectoryRPC) RoundKey(round *int, reply *RoundKeyReply) error {
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	deadline := time.Now().Add(MAX_POLL)
+	for d.d.RoundKeys[*round] == "" {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return fmt.Errorf("No key for round %d", *round)
+		}
+		d.d.waitChange(d.d.version, left)
+	}
+	reply.Key = d.d.RoundKeys[*round]
+	reply.Commits = d.d.RoundCommits[*round]
+	reply.Qual = d.d.RoundQuals[*round]
+	return nil
+}
+
+// Key returns the directory's long-term public key
+func (d *DirectoryRPC) Key(_ *int, key *string) error {
+	*key = DumpPubKey(d.d.keyPair.Pub)
 	return nil
 }
 
@@ -114,50 +885,96 @@ func (d *DirectoryRPC) Ping(_ *int, _ *int) error {
 	return nil
 }
 
-func (d *DirectoryRPC) Randomness(_ *int, seed *[SEED_LEN]byte) error {
-	*seed = SEED
+// Beacon is one directory's contribution to the group generation seed
+// for an epoch. Gamma is a VRF output under the directory's long-term
+// key, so the directory cannot pick it, and Proof lets anyone check it.
+type Beacon struct {
+	Epoch int
+	Gamma *Point
+	Proof DLEQProof
+}
+
+func beaconInput(epoch int) []byte {
+	return []byte(fmt.Sprintf("atom-beacon-%d", epoch))
+}
+
+func (d *DirectoryRPC) Randomness(epoch *int, beacon *Beacon) error {
+	_, gamma, proof := VRF(d.d.keyPair.Priv, beaconInput(*epoch))
+	beacon.Epoch = *epoch
+	beacon.Gamma = gamma
+	beacon.Proof = proof
 	return nil
 }
 
 func (d *Directory) Close() {
-	d.done.Wait()
-	d.gdone.Wait()
 	// Hopefully a second is enough to send back the last reply
 	time.Sleep(1 * time.Second)
 
 	if d.listener != nil {
 		d.listener.Close()
 	}
+	if d.httpListener != nil {
+		d.httpListener.Close()
+	}
+	if d.pool != nil {
+		d.pool.Close()
+	}
 }
 
-func NewDirectory(id, port, mode, netType,
-	numServers, numGroups, perGroup, numTrustees,
-	numMsgs, msgSize, threshold,
-	numClients int) (*Directory, error) {
-
-	tlsCert, tlsConfig := AtomTLSConfig()
-
-	numLevels := 10
-	if netType == BUTTERFLY {
-		numLevels = Log2(numGroups) * Log2(numGroups)
+// directoryKey reads the key of directory id from keyFile, or makes a
+// fresh one without a file
+func directoryKey(id int, keyFile string) (*KeyPair, error) {
+	if keyFile == "" {
+		return GenKey(), nil
 	}
+	keys, err := ReadKeys(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if id < 0 || id >= len(keys) {
+		return nil, fmt.Errorf("No key for directory %d in %s", id, keyFile)
+	}
+	return LoadKey(keys[id]), nil
+}
 
-	p := SystemParameter{
-		Mode:    mode,
-		NetType: netType,
-
-		NumServers:  numServers,
-		NumGroups:   numGroups,
-		PerGroup:    perGroup,
-		NumLevels:   numLevels,
-		NumTrustees: numTrustees,
+// checkKey checks the directory's key is the one the config commits
+// it to, if it commits to one
+func (d *Directory) checkKey() error {
+	if d.DirectoryKeys == nil {
+		return nil
+	}
+	if d.id < 0 || d.id >= len(d.DirectoryKeys) ||
+		d.DirectoryKeys[d.id] != DumpPubKey(d.keyPair.Pub) {
+		return fmt.Errorf("Key of directory %d is not the committed one", d.id)
+	}
+	return nil
+}
 
-		NumMsgs: numMsgs,
-		MsgSize: msgSize,
+func NewDirectory(id, port int, keyFile string, config *Config,
+	storePath string, tlsCert *tls.Certificate) (*Directory, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	keyPair, err := directoryKey(id, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if config.DirectoryKeys == nil {
+		log.Println("No committed directory keys; beacons trust each directory's key")
+	}
 
-		Threshold: threshold,
+	// others pin the directory's certificate, so it usually comes from
+	// a file; without one, a fresh one is made
+	var tlsConfig *tls.Config
+	if tlsCert == nil {
+		tlsCert, tlsConfig = AtomTLSConfig()
+	} else {
+		tlsConfig = TLSConfig(*tlsCert)
 	}
 
+	p := config.params()
+
 	l, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), tlsConfig)
 	if err != nil {
 		return nil, err
@@ -167,41 +984,81 @@ func NewDirectory(id, port, mode, netType,
 		id:   id,
 		port: port,
 
-		wg:   new(sync.WaitGroup),
-		done: new(sync.WaitGroup),
-
-		gwg:   new(sync.WaitGroup),
-		gdone: new(sync.WaitGroup),
-
 		listener: l,
 
 		tlsCert:   tlsCert,
 		tlsConfig: tlsConfig,
 
+		keyPair:  keyPair,
+		tokenKey: GenKey(),
+
+		storePath: storePath,
+
+		layouts: &layoutCache{lock: new(sync.Mutex)},
+
+		config:      config,
+		serverKeys:  allowlist(config.ServerKeys),
+		trusteeKeys: allowlist(config.TrusteeKeys),
+		clientKeys:  allowlist(config.ClientKeys),
+
+		lock:      new(sync.Mutex),
+		joins:     make(map[int]*Registration),
+		leaves:    make(map[int]bool),
+		roundRegs: make(map[int]map[int]*Registration),
+
+		clients:  make(map[int]*PublicKey),
+		issued:   make(map[int]map[int]int),
+		sessions: make(chan bool, 1),
+
+		verdicts: make(map[int]map[int]*Verdict),
+
+		Epoch:           0,
 		Round:           0,
 		SystemParameter: p,
 
-		Servers:      make([]string, numServers),
-		Keys:         make([]string, numServers),
-		Certificates: make([][][]byte, numServers),
+		Servers:      make([]string, p.NumServers),
+		Keys:         make([]string, p.NumServers),
+		Certificates: make([][][]byte, p.NumServers),
 
-		Trustees:     make([]string, numTrustees),
-		TrusteeKeys:  make([]string, numTrustees),
-		TrusteeCerts: make([][][]byte, numTrustees),
+		Trustees:     make([]string, p.NumTrustees),
+		TrusteeKeys:  make([]string, p.NumTrustees),
+		TrusteeCerts: make([][][]byte, p.NumTrustees),
 
-		GroupKeys: make([][]string, numLevels),
+		GroupKeys: newGroupKeys(p.NumLevels, p.NumGroups),
 		RoundKeys: make(map[int]string),
-	}
 
-	for level := range d.GroupKeys {
-		d.GroupKeys[level] = make([]string, numGroups)
-	}
+		RoundCommits: make(map[int][]string),
+		RoundQuals:   make(map[int][]int),
 
-	d.wg.Add(numServers + numTrustees)
-	d.gwg.Add(numGroups*numLevels + numTrustees)
+		DirectoryKeys: config.DirectoryKeys,
+	}
+	d.cond = sync.NewCond(d.lock)
 
-	d.done.Add(numServers + numTrustees)
-	d.gdone.Add(numClients + numServers)
+	if storePath != "" {
+		loaded, err := d.load()
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if loaded {
+			// otherwise the published config would not be the one
+			// in use
+			err = config.conflicts(d.SystemParameter, d.DirectoryKeys)
+			if err != nil {
+				l.Close()
+				return nil, err
+			}
+			log.Println("Restored directory at epoch", d.Epoch)
+		}
+	}
+	err = d.checkKey()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	if storePath != "" {
+		d.save()
+	}
 
 	rpcServer := rpc.NewServer()
 	rpcServer.Register(&DirectoryRPC{d})
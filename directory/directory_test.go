@@ -0,0 +1,846 @@
+package directory
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/kwonalbert/atom/atomrpc"
+	. "github.com/kwonalbert/atom/common"
+	. "github.com/kwonalbert/atom/crypto"
+)
+
+var dirPort = 12000
+
+func testConfig(mode, numServers, numGroups, perGroup, numTrustees int) *Config {
+	return &Config{
+		SystemParameter: SystemParameter{
+			Mode:        mode,
+			NetType:     BUTTERFLY,
+			NumServers:  numServers,
+			NumGroups:   numGroups,
+			PerGroup:    perGroup,
+			NumTrustees: numTrustees,
+			NumClients:  1,
+			NumMsgs:     1,
+			MsgSize:     1,
+		},
+	}
+}
+
+func register(d *DirectoryRPC, id int, key *KeyPair) error {
+	reg := &Registration{
+		Addr: "127.0.0.1:0",
+		Id:   id,
+		Key:  DumpPubKey(key.Pub),
+	}
+	reg.Sign(key.Priv)
+	return d.Register(reg, nil)
+}
+
+func registerTrustee(d *DirectoryRPC, id int, key *KeyPair) error {
+	reg := &Registration{
+		Addr: "127.0.0.1:0",
+		Id:   id,
+		Key:  DumpPubKey(key.Pub),
+	}
+	reg.Sign(key.Priv)
+	return d.RegisterTrustee(reg, nil)
+}
+
+// register roundKey for round as trustee id
+// registers roundKey as made by every trustee
+func registerRound(d *DirectoryRPC, round, id int, key *KeyPair, roundKey string) error {
+	qual := make([]int, len(d.d.TrusteeKeys))
+	for i := range qual {
+		qual[i] = i
+	}
+	reg := &Registration{
+		Round:   round,
+		Id:      id,
+		Key:     roundKey,
+		Commits: []string{roundKey},
+		Qual:    qual,
+	}
+	reg.SignRound(key.Priv)
+	return d.RegisterRound(reg, nil)
+}
+
+func TestRegister(t *testing.T) {
+	keys := []*KeyPair{GenKey(), GenKey(), GenKey()}
+	approved := []string{DumpPubKey(keys[0].Pub), DumpPubKey(keys[1].Pub)}
+
+	config := testConfig(VER_MODE, 3, 2, 1, 0)
+	config.ServerKeys = approved
+	d, err := NewDirectory(0, dirPort, "", config, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+	rpc := &DirectoryRPC{d}
+
+	if err := register(rpc, 0, keys[0]); err != nil {
+		t.Error(err)
+	}
+	if err := register(rpc, 0, keys[1]); err == nil {
+		t.Error("Re-registered an existing id")
+	}
+	if err := register(rpc, 1, keys[0]); err == nil {
+		t.Error("Registered the same key twice")
+	}
+	if err := register(rpc, 2, keys[2]); err == nil {
+		t.Error("Registered an unapproved key")
+	}
+
+	reg := &Registration{
+		Addr: "127.0.0.1:0",
+		Id:   1,
+		Key:  DumpPubKey(keys[1].Pub),
+	}
+	reg.Sign(keys[2].Priv)
+	if err := rpc.Register(reg, nil); err == nil {
+		t.Error("Registered a key without its signature")
+	}
+	if d.Keys[1] != "" {
+		t.Error("Rejected registration changed the directory")
+	}
+}
+
+func TestEpochs(t *testing.T) {
+	keys := []*KeyPair{GenKey(), GenKey(), GenKey()}
+
+	d, err := NewDirectory(0, dirPort+1, "", testConfig(VER_MODE, 2, 2, 1, 0),
+		"", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+	rpc := &DirectoryRPC{d}
+
+	if err := d.NextEpoch(); err == nil {
+		t.Error("Moved on before the first epoch was frozen")
+	}
+	for i := 0; i < 2; i++ {
+		if err := register(rpc, i, keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !d.frozen {
+		t.Fatal("First epoch not frozen after every server registered")
+	}
+
+	// joins only show up in the next epoch
+	if err := register(rpc, 2, keys[2]); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Keys) != 2 {
+		t.Error("Join changed the frozen epoch")
+	}
+
+	leave := &Registration{Epoch: 0, Id: 0, Key: DumpPubKey(keys[0].Pub)}
+	leave.Sign(keys[0].Priv)
+	if err := rpc.Leave(leave, nil); err == nil {
+		t.Error("Accepted a registration signature as a leave")
+	}
+	leave.SignLeave(keys[0].Priv)
+	if err := rpc.Leave(leave, nil); err != nil {
+		t.Error(err)
+	}
+
+	var reply EpochReply
+	args := WaitArgs{After: 0, Timeout: 50 * time.Millisecond}
+	rpc.WaitEpoch(&args, &reply)
+	if reply.Epoch != -1 || reply.Status != d.status() || reply.Version != d.version {
+		t.Error("Wrong reply when the wait expired")
+	}
+
+	if err := d.NextEpoch(); err != nil {
+		t.Fatal(err)
+	}
+	reply = EpochReply{}
+	rpc.WaitEpoch(&args, &reply)
+	if reply.Epoch != 1 {
+		t.Error("Wait missed the next epoch")
+	}
+	if d.Epoch != 1 || len(d.Keys) != 3 {
+		t.Error("Join missing from the next epoch")
+	}
+	if d.Keys[0] != "" || d.Servers[0] != "" {
+		t.Error("Leave missing from the next epoch")
+	}
+
+	// neither is an old leave or registration in a later epoch
+	if err := rpc.Leave(leave, nil); err == nil {
+		t.Error("Accepted a leave from an earlier epoch")
+	}
+	if err := register(rpc, 0, keys[0]); err == nil {
+		t.Error("Accepted a registration from an earlier epoch")
+	}
+}
+
+func TestRegisterGroup(t *testing.T) {
+	keys := []*KeyPair{GenKey(), GenKey()}
+	d, err := NewDirectory(0, dirPort+14, "", testConfig(VER_MODE, 2, 2, 1, 0),
+		"", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+	rpc := &DirectoryRPC{d}
+	for i := range keys {
+		if err := register(rpc, i, keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap := d.snapshot(false)
+	groups, err := d.layout(&snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := groups[0][0].Members[0]
+	reg := &Registration{
+		Epoch:  d.Epoch,
+		Level:  0,
+		Member: first,
+		Id:     0,
+		Key:    DumpPubKey(GenKey().Pub),
+	}
+	if err := rpc.RegisterGroup(reg, nil); err == nil {
+		t.Error("Accepted an unsigned group key")
+	}
+	reg.SignGroup(GenKey().Priv)
+	if err := rpc.RegisterGroup(reg, nil); err == nil {
+		t.Error("Accepted a group key signed by an unknown key")
+	}
+
+	other := 1 - first
+	reg.Member = other
+	reg.SignGroup(keys[other].Priv)
+	if err := rpc.RegisterGroup(reg, nil); err == nil {
+		t.Error("Accepted a group key from a server other than the first member")
+	}
+
+	reg.Member = first
+	reg.SignGroup(keys[first].Priv)
+	if err := rpc.RegisterGroup(reg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if d.GroupKeys[0][0] != reg.Key {
+		t.Error("Group key missing")
+	}
+}
+
+func TestStore(t *testing.T) {
+	keys := []*KeyPair{GenKey(), GenKey(), GenKey()}
+	dir, err := ioutil.TempDir("", "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := filepath.Join(dir, "state.json")
+
+	d, err := NewDirectory(0, dirPort+2, "", testConfig(VER_MODE, 2, 2, 1, 0),
+		store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc := &DirectoryRPC{d}
+	for i := range keys {
+		if err := register(rpc, i, keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.NextEpoch(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.StartSchedule(time.Hour, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	d.listener.Close()
+
+	// "restart" the directory, first with conflicting parameters
+	_, err = NewDirectory(0, dirPort+3, "", testConfig(VER_MODE, 4, 4, 2, 0),
+		store, nil)
+	if err == nil {
+		t.Error("Restored the directory under a conflicting config")
+	}
+	r, err := NewDirectory(0, dirPort+3, "", testConfig(VER_MODE, 2, 2, 1, 0),
+		store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.listener.Close()
+
+	if r.Epoch != d.Epoch || !r.frozen {
+		t.Error("Restored the wrong epoch")
+	}
+	if r.NumServers != 3 || r.PerGroup != 1 {
+		t.Error("Restored the wrong parameters")
+	}
+	if !bytes.Equal(r.Digest(), d.Digest()) {
+		t.Error("Restored directory differs")
+	}
+	if !r.keyPair.Pub.Equal(d.keyPair.Pub) {
+		t.Error("Restored directory has a different key")
+	}
+	started, err := r.StartSchedule(2*time.Hour, time.Minute)
+	if err != nil || started || r.Schedule != d.Schedule {
+		t.Error("Restored schedule replaced:", r.Schedule, err)
+	}
+}
+
+func TestScheduleStart(t *testing.T) {
+	config := testConfig(VER_MODE, 2, 2, 1, 0)
+	config.NumDirs = 2
+	d, err := NewDirectory(0, dirPort+13, "", config, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+	if _, err := d.StartSchedule(time.Hour, time.Minute); err == nil {
+		t.Error("Several directories picked their own round start")
+	}
+	start := time.Now().Add(time.Hour).UTC()
+	d.config.RoundStart = start
+	if _, err := d.StartSchedule(time.Hour, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Schedule.Start.Equal(start) {
+		t.Error("Wrong round start:", d.Schedule.Start)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	keys := []*KeyPair{GenKey(), GenKey()}
+	d, err := NewDirectory(0, dirPort+4, "", testConfig(VER_MODE, 2, 2, 1, 0),
+		"", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+	rpc := &DirectoryRPC{d}
+
+	var reply DirectoryReply
+	rpc.Directory(&DirectoryArgs{}, &reply)
+	if reply.Status != REGISTERING || reply.Directory != nil {
+		t.Error("Directory returned before registration finished")
+	}
+
+	for i := range keys {
+		if err := register(rpc, i, keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rpc.Directory(&DirectoryArgs{}, &reply)
+	if reply.Status != KEYS_PENDING || reply.Directory == nil {
+		t.Error("Directory not returned after registration")
+	}
+	version := reply.Version
+
+	// nothing changes, so the long-poll should run into its timeout
+	start := time.Now()
+	timeout := 100 * time.Millisecond
+	args := &DirectoryArgs{Version: version, Timeout: timeout}
+	rpc.DirectoryWithGroupKeys(args, &reply)
+	if time.Since(start) < timeout {
+		t.Error("Long-poll returned without a change")
+	}
+	if reply.Version != version || reply.Directory != nil {
+		t.Error("Directory with group keys returned before the keys")
+	}
+}
+
+func TestHTTPView(t *testing.T) {
+	keys := []*KeyPair{GenKey(), GenKey()}
+	d, err := NewDirectory(0, dirPort+5, "", testConfig(VER_MODE, 2, 2, 1, 0),
+		"", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+	rpc := &DirectoryRPC{d}
+	for i := range keys {
+		if err := register(rpc, i, keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := httptest.NewServer(d.Handler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/v1/directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var signed SignedView
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+
+	view, err := VerifyView(&signed, d.keyPair.Pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view.APIVersion != API_VERSION || view.Status != KEYS_PENDING {
+		t.Error("Wrong version or status")
+	}
+	if len(view.Servers) != len(keys) {
+		t.Error("Missing servers")
+	}
+	if len(view.Groups) != d.NumLevels*d.NumGroups {
+		t.Error("Missing groups")
+	}
+
+	// one of several directories can't compute the layout alone
+	d.config.NumDirs = 2
+	alone, err := d.view()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alone.Groups) != 0 {
+		t.Error("Served a layout without the other directories")
+	}
+
+	signed.Directory[len(signed.Directory)-2] ^= 1
+	if _, err := VerifyView(&signed, d.keyPair.Pub); err == nil {
+		t.Error("Accepted a modified view")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	d, err := NewDirectory(0, dirPort+6, "", testConfig(TRAP_MODE, 2, 2, 1, 1),
+		"", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+	rpc := &DirectoryRPC{d}
+
+	trustee := GenKey()
+	for i := 0; i < 2; i++ {
+		if err := register(rpc, i, GenKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registerTrustee(rpc, 0, trustee); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(100 * time.Millisecond)
+	period := 200 * time.Millisecond
+	if err := d.SetSchedule(start, period, period/2); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a key, the wait expires with the current status
+	var reply RoundReply
+	args := WaitArgs{After: -1, Timeout: 50 * time.Millisecond}
+	if err := rpc.NextRound(&args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Info != nil || reply.Status != KEYS_PENDING ||
+		reply.Version != d.version {
+		t.Error("Wrong reply when the wait expired")
+	}
+
+	// the round key arrives after round 0 opens
+	key := DumpPubKey(GenKey().Pub)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		registerRound(rpc, 0, 0, trustee, key)
+	}()
+
+	args = WaitArgs{After: -1, Timeout: MAX_POLL}
+	reply = RoundReply{}
+	if err := rpc.NextRound(&args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	info := reply.Info
+	if info == nil || info.Round != 0 || info.Key != key {
+		t.Fatal("Wrong round announced")
+	}
+	if time.Now().Before(info.Open) || !info.Close.Equal(info.Open.Add(period/2)) {
+		t.Error("Round announced before it opened")
+	}
+
+	// round 0 has closed by now, so the next round is 1
+	time.Sleep(info.Close.Sub(time.Now()))
+	registerRound(rpc, 1, 0, trustee, key)
+	reply = RoundReply{}
+	rpc.NextRound(&args, &reply)
+	if reply.Info == nil || reply.Info.Round != 1 ||
+		time.Now().Before(reply.Info.Open) {
+		t.Error("Announced a closed round")
+	}
+
+	// round 2 closes without a key, so the wait moves on to round 3
+	registerRound(rpc, 3, 0, trustee, key)
+	args.After = 1
+	reply = RoundReply{}
+	rpc.NextRound(&args, &reply)
+	if reply.Info == nil || reply.Info.Round != 3 {
+		t.Error("Waited on a round that closed without a key")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "atom-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	keys, _ := json.Marshal([]string{DumpPubKey(GenKey().Pub)})
+	ioutil.WriteFile(filepath.Join(tmp, "pubs.json"), keys, 0644)
+	fn := filepath.Join(tmp, "config.json")
+	ioutil.WriteFile(fn, []byte(`{"Mode": 1, "NetType": 1, "NumServers": 4,
+		"NumGroups": 3, "PerGroup": 2, "NumTrustees": 1, "NumClients": 2, "NumMsgs": 3,
+		"MsgSize": 1, "ServerKeyFile": "pubs.json"}`), 0644)
+
+	config, err := LoadConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.ServerKeys) != 1 || config.TrusteeKeys != nil {
+		t.Error("Keys not loaded from the key file")
+	}
+	p := config.params()
+	if p.NumLevels != 10 || p.Threshold != p.PerGroup-1 ||
+		p.TrusteeThreshold != p.NumTrustees {
+		t.Error("Wrong defaults")
+	}
+
+	bad := *config
+	bad.Threshold = bad.PerGroup + 1
+	if bad.Validate() == nil {
+		t.Error("Accepted a threshold larger than the groups")
+	}
+	bad = *config
+	bad.NetType = BUTTERFLY
+	if bad.Validate() == nil {
+		t.Error("Accepted a butterfly of 3 groups")
+	}
+	bad = *config
+	bad.NumTrustees = 0
+	if bad.Validate() == nil {
+		t.Error("Accepted trap mode without trustees")
+	}
+	bad = *config
+	bad.NumClients = 0
+	if bad.Validate() == nil {
+		t.Error("Accepted a config without clients")
+	}
+	bad = *config
+	bad.TrusteeThreshold = 2
+	if bad.Validate() == nil {
+		t.Error("Accepted a trustee threshold larger than the trustees")
+	}
+}
+
+func TestVerdicts(t *testing.T) {
+	d, err := NewDirectory(0, dirPort+7, "", testConfig(TRAP_MODE, 2, 2, 1, 1),
+		"", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+	rpc := &DirectoryRPC{d}
+
+	key := GenKey()
+	if err := registerTrustee(rpc, 0, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// round 3 is underway from its key until its verdict
+	d.RoundKeys[3] = DumpPubKey(GenKey().Pub)
+	if !d.roundRunning(time.Now()) {
+		t.Error("Keyed round not underway")
+	}
+	verdict := &Verdict{Round: 3, Decision: RELEASE}
+	verdict.Sign(key.Priv)
+	if err := rpc.RegisterVerdict(verdict, nil); err != nil {
+		t.Error(err)
+	}
+	if d.roundRunning(time.Now()) {
+		t.Error("Decided round still underway")
+	}
+	if err := rpc.RegisterVerdict(verdict, nil); err != nil {
+		t.Error("Rejected the same verdict twice:", err)
+	}
+
+	// a trustee can't change its mind, or speak for another
+	changed := &Verdict{Round: 3, Decision: WITHHOLD}
+	changed.Sign(key.Priv)
+	if err := rpc.RegisterVerdict(changed, nil); err == nil {
+		t.Error("Accepted a second verdict")
+	}
+	forged := &Verdict{Round: 4, Decision: RELEASE}
+	forged.Sign(GenKey().Priv)
+	if err := rpc.RegisterVerdict(forged, nil); err == nil {
+		t.Error("Accepted a forged verdict")
+	}
+
+	var verdicts []*Verdict
+	round := 3
+	rpc.Verdicts(&round, &verdicts)
+	if len(verdicts) != 1 || verdicts[0].Decision != RELEASE {
+		t.Error("Wrong verdicts:", verdicts)
+	}
+}
+
+func TestRoundKey(t *testing.T) {
+	d, err := NewDirectory(0, dirPort+8, "", testConfig(TRAP_MODE, 1, 1, 1, 2),
+		"", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+	rpc := &DirectoryRPC{d}
+
+	trustees := []*KeyPair{GenKey(), GenKey()}
+	roundKey := DumpPubKey(GenKey().Pub)
+	if err := registerRound(rpc, 0, 0, trustees[0], roundKey); err == nil {
+		t.Error("Registered a round key before the trustees were fixed")
+	}
+	register(rpc, 0, GenKey())
+	for i, key := range trustees {
+		if err := registerTrustee(rpc, i, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := registerRound(rpc, 0, 0, GenKey(), roundKey); err == nil {
+		t.Error("Registered a round key not signed by the trustee")
+	}
+	reg := &Registration{Round: 0, Id: 0, Key: roundKey,
+		Commits: []string{roundKey}, Qual: []int{0}}
+	reg.SignRound(trustees[0].Priv)
+	if err := rpc.RegisterRound(reg, nil); err == nil {
+		t.Error("Registered a round key made by fewer than TrusteeThreshold trustees")
+	}
+	if err := registerRound(rpc, 0, 0, trustees[0], roundKey); err != nil {
+		t.Fatal(err)
+	}
+	if d.RoundKeys[0] != "" {
+		t.Error("Round key published before every trustee registered it")
+	}
+	other := DumpPubKey(GenKey().Pub)
+	if err := registerRound(rpc, 0, 1, trustees[1], other); err == nil {
+		t.Error("Accepted a different round key")
+	}
+	if err := registerRound(rpc, 0, 1, trustees[1], roundKey); err != nil {
+		t.Fatal(err)
+	}
+	if d.RoundKeys[0] != roundKey {
+		t.Error("Round key not published")
+	}
+
+	var reply RoundKeyReply
+	round := 0
+	if err := rpc.RoundKey(&round, &reply); err != nil || reply.Key != roundKey ||
+		len(reply.Qual) != 2 {
+		t.Error("Wrong round key:", reply.Key, reply.Qual, err)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	key := GenKey()
+	config := testConfig(TRAP_MODE, 1, 1, 1, 1)
+	config.Auth = true
+	if config.Validate() == nil {
+		t.Error("Accepted tokens without approved client keys")
+	}
+	config.ClientKeys = []string{DumpPubKey(key.Pub)}
+	d, err := NewDirectory(0, dirPort+9, "", config, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+	rpc := &DirectoryRPC{d}
+
+	other := GenKey()
+	reg := &Registration{Id: 1, Key: DumpPubKey(other.Pub)}
+	reg.Sign(other.Priv)
+	if rpc.RegisterClient(reg, nil) == nil {
+		t.Error("Registered a client with an unapproved key")
+	}
+	reg = &Registration{Id: 0, Key: DumpPubKey(key.Pub)}
+	reg.Sign(key.Priv)
+	if err := rpc.RegisterClient(reg, nil); err != nil {
+		t.Fatal(err)
+	}
+	reg = &Registration{Id: 1, Key: DumpPubKey(key.Pub)}
+	reg.Sign(key.Priv)
+	if rpc.RegisterClient(reg, nil) == nil {
+		t.Error("Registered a key under a second id")
+	}
+
+	args := &TokenArgs{Round: 0, Id: 0}
+	args.Sign(key.Priv)
+	var R Point
+	if err := rpc.TokenCommit(args, &R); err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("token")
+	var tokenKey TokenKey
+	rpc.TokenKey(nil, &tokenKey)
+	pub, err := tokenKey.Verify(d.keyPair.Pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blinding, C := Blind(pub, &R, msg)
+	args.C = C
+	args.Sign(key.Priv)
+	var s Scalar
+	if err := rpc.TokenSign(args, &s); err != nil {
+		t.Fatal(err)
+	}
+	token := Unblind(blinding, &s)
+	if err := VerifyBlind(pub, msg, token); err != nil {
+		t.Error(err)
+	}
+	// the token is no signature by the directory's own key
+	if Verify(d.keyPair.Pub, msg, token) == nil || VerifyBlind(d.keyPair.Pub, msg, token) == nil {
+		t.Error("Token signed with the directory's long-term key")
+	}
+	if rpc.TokenSign(args, &s) == nil {
+		t.Error("Signed twice with one commitment")
+	}
+
+	// NumMsgs is 1
+	args = &TokenArgs{Round: 0, Id: 0}
+	args.Sign(key.Priv)
+	if rpc.TokenCommit(args, &R) == nil {
+		t.Error("Issued more tokens than msgs")
+	}
+
+	// with two directories, round 1 is the other one's
+	d.config.NumDirs = 2
+	args = &TokenArgs{Round: 1, Id: 0}
+	args.Sign(key.Priv)
+	if rpc.TokenCommit(args, &R) == nil {
+		t.Error("Issued tokens for another directory's round")
+	}
+}
+
+func TestDirectoryKeys(t *testing.T) {
+	key := GenKey()
+	dir, err := ioutil.TempDir("", "atom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "directory_keys.json")
+	b, err := json.Marshal([]HexKeyPair{DumpKey(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig(VER_MODE, 1, 1, 1, 0)
+	config.DirectoryKeys = []string{DumpPubKey(key.Pub)}
+	if _, err := NewDirectory(0, dirPort+10, "", config, "", nil); err == nil {
+		t.Error("Started with a key other than the committed one")
+	}
+	d, err := NewDirectory(0, dirPort+10, keyFile, config, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+
+	snap := d.snapshot(false)
+	if err := checkDirectoryKeys(&snap, []*PublicKey{key.Pub}); err != nil {
+		t.Error(err)
+	}
+	if checkDirectoryKeys(&snap, []*PublicKey{GenKey().Pub}) == nil {
+		t.Error("Accepted a directory key other than the committed one")
+	}
+}
+
+func TestCombineBeacons(t *testing.T) {
+	outs := [][]byte{[]byte("a"), []byte("b")}
+	seed, err := combineBeacons(outs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := combineBeacons(outs)
+	if seed != again {
+		t.Error("Same beacons gave different seeds")
+	}
+	if _, err := combineBeacons([][]byte{[]byte("a"), nil}); err == nil {
+		t.Error("Made a seed without every beacon")
+	}
+}
+
+func TestFetchDeadline(t *testing.T) {
+	d, err := NewDirectory(0, dirPort+11, "", testConfig(VER_MODE, 2, 2, 1, 0),
+		"", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+
+	_, tlsConfig := AtomTLSConfig()
+	conn, err := DialPinned(fmt.Sprintf("127.0.0.1:%d", dirPort+11), tlsConfig,
+		d.tlsCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	// no server ever registers
+	start := time.Now()
+	_, err = fetch(client, "DirectoryRPC.Directory", KEYS_PENDING, 100*time.Millisecond)
+	if err == nil {
+		t.Error("Fetched a directory that never froze")
+	}
+	if time.Since(start) > POLL_TIMEOUT {
+		t.Error("Waited past the deadline")
+	}
+}
+
+func TestDigestGob(t *testing.T) {
+	// no trustees, so the directory has empty slices gob drops
+	d, err := NewDirectory(0, dirPort+12, "", testConfig(VER_MODE, 2, 2, 1, 0),
+		"", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.listener.Close()
+	rpc := &DirectoryRPC{d}
+	for i := 0; i < 2; i++ {
+		if err := register(rpc, i, GenKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, withKeys := range []bool{false, true} {
+		d.lock.Lock()
+		snap := d.snapshot(withKeys)
+		d.lock.Unlock()
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(&snap); err != nil {
+			t.Fatal(err)
+		}
+		var got Directory
+		if err := gob.NewDecoder(buf).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(d.keyPair.Pub, got.Digest(), got.Sig); err != nil {
+			t.Error("Snapshot does not verify after gob:", err)
+		}
+	}
+}
@@ -1,56 +1,155 @@
 package directory
 
 import (
+	"fmt"
 	"log"
 	"net/rpc"
+	"strings"
+	"time"
 
+	. "github.com/kwonalbert/atom/atomrpc"
 	. "github.com/kwonalbert/atom/common"
 	. "github.com/kwonalbert/atom/crypto"
+
+	"golang.org/x/crypto/sha3"
 )
 
-func GetDirectory(dirServers []*rpc.Client) (*Directory, SystemParameter, []*PublicKey) {
-	// TODO:  actually check consensus
-	var res *Directory
-	var params SystemParameter
-	for _, dirServer := range dirServers {
-		var direc Directory
-		err := dirServer.Call("DirectoryRPC.Directory", 0, &direc)
+// how long each directory call long-polls for a change
+const POLL_TIMEOUT = 10 * time.Second
+
+// how long a participant waits for a directory to reach the status it
+// needs, e.g. for every server of the first epoch to register
+const MAX_WAIT = 30 * time.Minute
+
+// fetch asks dirServer for its snapshot using method, long-polling
+// until the directory reaches status need, or for at most wait
+func fetch(dirServer *rpc.Client, method string, need int,
+	wait time.Duration) (*Directory, error) {
+	args := DirectoryArgs{
+		Version: -1, // never the current version, so the first call returns
+		Timeout: POLL_TIMEOUT,
+	}
+	deadline := time.Now().Add(wait)
+	status := -1
+	for {
+		var reply DirectoryReply
+		err := AtomRPC(dirServer, method, &args, &reply,
+			args.Timeout+DEFAULT_TIMEOUT)
 		if err != nil {
-			log.Fatal("Directory err:", err)
+			return nil, err
+		}
+		if reply.Status >= need && reply.Directory != nil {
+			return reply.Directory, nil
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, fmt.Errorf("Directory still at status %d after %v",
+				reply.Status, wait)
+		}
+		if reply.Status != status {
+			log.Println("Waiting for the directory, status", reply.Status)
+			status = reply.Status
+		}
+		args.Version = reply.Version
+		if left < POLL_TIMEOUT {
+			args.Timeout = left
 		}
-		res = &direc
-		params = direc.SystemParameter
 	}
+}
 
-	publicKeys := make([]*PublicKey, len(res.Keys))
-	for i, pub := range res.Keys {
-		publicKeys[i] = LoadPubKey(pub)
+// getConsensus asks every directory server for its snapshot using
+// method, and returns the snapshot that at least quorum of them signed.
+// quorum must be a majority, so that at most one snapshot can win.
+func getConsensus(dirServers []*rpc.Client, dirKeys []*PublicKey,
+	quorum int, method string, need int) (*Directory, error) {
+	if quorum > len(dirServers) || 2*quorum <= len(dirServers) {
+		return nil, fmt.Errorf("Quorum %d is not a majority of %d directories",
+			quorum, len(dirServers))
 	}
-	return res, params, publicKeys
-}
 
-func GetGroupKeys(dirServers []*rpc.Client) (*Directory, SystemParameter, []*PublicKey, [][]*PublicKey) {
-	var res *Directory
-	var params SystemParameter
+	votes := make(map[string][]int) // digest to directories
+	snapshots := make(map[string]*Directory)
+	var errs []string
+	for d, dirServer := range dirServers {
+		direc, err := fetch(dirServer, method, need, MAX_WAIT)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("directory %d: %v", d, err))
+			continue
+		}
+		digest := direc.Digest()
+		err = Verify(dirKeys[d], digest, direc.Sig)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("directory %d: %v", d, err))
+			continue
+		}
+		votes[string(digest)] = append(votes[string(digest)], d)
+		snapshots[string(digest)] = direc
+	}
 
-	// TODO:  actually check consensus
-	for _, dirServer := range dirServers {
+	if len(votes) > 1 {
+		var groups []string
+		for _, ds := range votes {
+			groups = append(groups, fmt.Sprint(ds))
+		}
+		errs = append(errs, "directories disagree: "+strings.Join(groups, " vs "))
+	}
 
-		var direc Directory
-		err := dirServer.Call("DirectoryRPC.DirectoryWithGroupKeys", 0, &direc)
-		if err != nil {
-			log.Fatal("Directory err:", err)
+	for digest, ds := range votes {
+		if len(ds) >= quorum {
+			err := checkDirectoryKeys(snapshots[digest], dirKeys)
+			if err != nil {
+				return nil, err
+			}
+			if len(errs) > 0 {
+				log.Println("Directory quorum reached despite:", strings.Join(errs, "; "))
+			}
+			return snapshots[digest], nil
 		}
+	}
+	return nil, fmt.Errorf("No quorum of %d directories: %s",
+		quorum, strings.Join(errs, "; "))
+}
 
-		res = &direc
-		params = direc.SystemParameter
+// checkDirectoryKeys checks that dirKeys, as the directories gave them,
+// are the keys the directories committed to, if they committed to any
+func checkDirectoryKeys(dir *Directory, dirKeys []*PublicKey) error {
+	if dir.DirectoryKeys == nil {
+		return nil
+	}
+	if len(dir.DirectoryKeys) != len(dirKeys) {
+		return fmt.Errorf("%d directories, but %d committed keys",
+			len(dirKeys), len(dir.DirectoryKeys))
 	}
+	for d, key := range dirKeys {
+		if DumpPubKey(key) != dir.DirectoryKeys[d] {
+			return fmt.Errorf("Key of directory %d is not the committed one", d)
+		}
+	}
+	return nil
+}
+
+func GetDirectory(dirServers []*rpc.Client, dirKeys []*PublicKey,
+	quorum int) (*Directory, SystemParameter, []*PublicKey, error) {
+	res, err := getConsensus(dirServers, dirKeys, quorum, "DirectoryRPC.Directory",
+		KEYS_PENDING)
+	if err != nil {
+		return nil, SystemParameter{}, nil, err
+	}
+
+	publicKeys := loadServerKeys(res.Keys)
+	return res, res.SystemParameter, publicKeys, nil
+}
 
-	publicKeys := make([]*PublicKey, len(res.Keys))
-	for i, pub := range res.Keys {
-		publicKeys[i] = LoadPubKey(pub)
+func GetGroupKeys(dirServers []*rpc.Client, dirKeys []*PublicKey,
+	quorum int) (*Directory, SystemParameter, []*PublicKey, [][]*PublicKey, error) {
+	res, err := getConsensus(dirServers, dirKeys, quorum, "DirectoryRPC.DirectoryWithGroupKeys",
+		READY)
+	if err != nil {
+		return nil, SystemParameter{}, nil, nil, err
 	}
 
+	publicKeys := loadServerKeys(res.Keys)
+
 	keys := make([][]*PublicKey, len(res.GroupKeys))
 	for level := range res.GroupKeys {
 		keys[level] = make([]*PublicKey, len(res.GroupKeys[level]))
@@ -59,5 +158,227 @@ func GetGroupKeys(dirServers []*rpc.Client) (*Directory, SystemParameter, []*Pub
 			keys[level][gid] = key
 		}
 	}
-	return res, params, publicKeys, keys
+	return res, res.SystemParameter, publicKeys, keys, nil
+}
+
+// ids not in use in the epoch get a nil key
+func loadServerKeys(keys []string) []*PublicKey {
+	publicKeys := make([]*PublicKey, len(keys))
+	for i, pub := range keys {
+		if pub != "" {
+			publicKeys[i] = LoadPubKey(pub)
+		}
+	}
+	return publicKeys
+}
+
+// WaitEpoch blocks until the directories are past epoch, and returns
+// the newest epoch. Directories that fail are skipped, as long as one
+// of them answers.
+func WaitEpoch(dirServers []*rpc.Client, epoch int) (int, error) {
+	next := -1
+	var err error
+	for _, dirServer := range dirServers {
+		e, cerr := waitEpoch(dirServer, epoch)
+		if cerr != nil {
+			err = cerr
+			continue
+		}
+		if e > next {
+			next = e
+		}
+	}
+	if next < 0 {
+		return next, err
+	}
+	return next, nil
+}
+
+// waitEpoch asks dirServer again whenever a wait expires
+func waitEpoch(dirServer *rpc.Client, epoch int) (int, error) {
+	args := WaitArgs{After: epoch, Timeout: MAX_POLL}
+	for {
+		var reply EpochReply
+		err := dirServer.Call("DirectoryRPC.WaitEpoch", &args, &reply)
+		if err != nil {
+			return -1, err
+		} else if reply.Epoch >= 0 {
+			return reply.Epoch, nil
+		}
+	}
+}
+
+// WaitRound blocks until quorum of the directories announce the same
+// round after round with the same key, see DirectoryRPC.NextRound
+func WaitRound(dirServers []*rpc.Client, quorum, round int) (*RoundInfo, error) {
+	type answer struct {
+		info RoundInfo
+		err  error
+	}
+	answers := make(chan answer, len(dirServers))
+	for _, dirServer := range dirServers {
+		go func(dirServer *rpc.Client) {
+			args := WaitArgs{After: round, Timeout: MAX_POLL}
+			for {
+				var reply RoundReply
+				err := dirServer.Call("DirectoryRPC.NextRound", &args, &reply)
+				if err != nil {
+					answers <- answer{err: err}
+					return
+				} else if reply.Info != nil {
+					answers <- answer{info: *reply.Info}
+					return
+				}
+			}
+		}(dirServer)
+	}
+
+	votes := make(map[RoundInfo]int)
+	var err error
+	for range dirServers {
+		a := <-answers
+		if a.err != nil {
+			err = a.err
+			continue
+		}
+		// the times are fixed by the schedule all of them agree on
+		vote := RoundInfo{Round: a.info.Round, Key: a.info.Key}
+		votes[vote]++
+		if votes[vote] >= quorum {
+			return &a.info, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("No quorum of %d directories for the round after %d",
+		quorum, round)
+}
+
+// RoundKey is the key of a round as the trustees made it
+type RoundKey struct {
+	Key     *PublicKey
+	Commits []*PublicKey // public polynomial, giving each trustee's share
+	Qual    []int        // trustees whose deals made the key
+}
+
+// GetRoundKey returns the key of round once quorum of the directories
+// agree on it
+func GetRoundKey(dirServers []*rpc.Client, quorum, round int) (*RoundKey, error) {
+	votes := make(map[string]int)
+	var errs []string
+	for d, dirServer := range dirServers {
+		var reply RoundKeyReply
+		err := dirServer.Call("DirectoryRPC.RoundKey", round, &reply)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("directory %d: %v", d, err))
+			continue
+		}
+		vote := fmt.Sprint(reply.Key, reply.Commits, reply.Qual)
+		votes[vote]++
+		if votes[vote] < quorum {
+			continue
+		}
+		key, err := ParsePubKey(reply.Key)
+		if err != nil {
+			return nil, err
+		}
+		commits := make([]*PublicKey, len(reply.Commits))
+		for i, c := range reply.Commits {
+			commits[i], err = ParsePubKey(c)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &RoundKey{key, commits, reply.Qual}, nil
+	}
+	return nil, fmt.Errorf("No quorum of %d directories for the key of round %d: %s",
+		quorum, round, strings.Join(errs, "; "))
+}
+
+// GetKeys returns the long-term public key of each directory server
+func GetKeys(dirServers []*rpc.Client) []*PublicKey {
+	keys := make([]*PublicKey, len(dirServers))
+	for d, dirServer := range dirServers {
+		var key string
+		err := dirServer.Call("DirectoryRPC.Key", 0, &key)
+		if err != nil {
+			log.Fatal("Directory key err:", err)
+		}
+		keys[d] = LoadPubKey(key)
+	}
+	return keys
+}
+
+// GetTokenKeys returns the key each directory server issues tokens
+// with, checked against its long-term key
+func GetTokenKeys(dirServers []*rpc.Client, dirKeys []*PublicKey) ([]*PublicKey, error) {
+	keys := make([]*PublicKey, len(dirServers))
+	for d, dirServer := range dirServers {
+		var key TokenKey
+		err := dirServer.Call("DirectoryRPC.TokenKey", 0, &key)
+		if err != nil {
+			return nil, fmt.Errorf("directory %d: %v", d, err)
+		}
+		keys[d], err = key.Verify(dirKeys[d])
+		if err != nil {
+			return nil, fmt.Errorf("directory %d: %v", d, err)
+		}
+	}
+	return keys, nil
+}
+
+// GetRandomness derives the group generation seed for epoch from the
+// beacons of every directory server, in order. The set is fixed by the
+// directories committed to in the epoch's snapshot (see
+// Config.DirectoryKeys), so it fails if any beacon is missing instead
+// of leaving it out, and everyone either gets the same seed or none.
+// Every beacon is checked against the directory's key; since a VRF
+// output is fixed once the key is, a directory can at most withhold its
+// beacon, not pick it.
+func GetRandomness(dirServers []*rpc.Client, dirKeys []*PublicKey,
+	epoch int) ([SEED_LEN]byte, error) {
+	var seed [SEED_LEN]byte
+	outs := make([][]byte, len(dirServers))
+	var errs []string
+	for d, dirServer := range dirServers {
+		var beacon Beacon
+		err := dirServer.Call("DirectoryRPC.Randomness", epoch, &beacon)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("directory %d: %v", d, err))
+			continue
+		}
+		if beacon.Epoch != epoch {
+			errs = append(errs, fmt.Sprintf("directory %d: beacon for epoch %d",
+				d, beacon.Epoch))
+			continue
+		}
+		outs[d], err = VerifyVRF(dirKeys[d], beaconInput(epoch),
+			beacon.Gamma, beacon.Proof)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("directory %d: %v", d, err))
+		}
+	}
+	if errs != nil {
+		return seed, fmt.Errorf("Missing %d of %d beacons: %s",
+			len(errs), len(dirServers), strings.Join(errs, "; "))
+	}
+	return combineBeacons(outs)
+}
+
+// the seed is a hash of every directory's VRF output with its id, in
+// order
+func combineBeacons(outs [][]byte) ([SEED_LEN]byte, error) {
+	var seed [SEED_LEN]byte
+	var inp []byte
+	for d, out := range outs {
+		if out == nil {
+			return seed, fmt.Errorf("No beacon from directory %d", d)
+		}
+		inp = append(inp, byte(d>>8), byte(d))
+		inp = append(inp, out...)
+	}
+	digest := sha3.Sum256(inp)
+	copy(seed[:], digest[:])
+	return seed, nil
 }
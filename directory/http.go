@@ -0,0 +1,319 @@
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/kwonalbert/atom/atomrpc"
+	. "github.com/kwonalbert/atom/common"
+	. "github.com/kwonalbert/atom/crypto"
+)
+
+// version of the JSON served over http; bump it when the format changes
+const API_VERSION = 1
+
+// how long an http client gets to send its request; the reply may
+// take up to MAX_POLL, to fetch the other directories' beacons
+const HTTP_READ_TIMEOUT = 10 * time.Second
+
+type ServerView struct {
+	Id   int
+	Addr string
+	Key  string
+}
+
+type GroupView struct {
+	Level   int
+	Gid     int
+	Members []int  // server ids
+	Key     string // empty until the group registers it
+}
+
+// A read-only view of the directory, for monitoring and tools that do
+// not speak the RPC protocol
+type DirectoryView struct {
+	APIVersion int
+	Version    int // the directory's change counter
+	Status     int
+	Epoch      int
+	Round      int
+
+	Params   SystemParameter
+	Schedule Schedule
+
+	Servers  []ServerView
+	Trustees []ServerView
+	Groups   []GroupView // empty until the epoch is frozen, or without peers
+
+	RoundKeys map[int]string
+}
+
+// Directory is the JSON encoded DirectoryView (or Config), exactly as
+// signed
+type SignedView struct {
+	Directory json.RawMessage
+	Key       string // the directory's public key
+	Signature string // hex encoded, see Signature.Hex
+}
+
+// the layout of an epoch only depends on the directories' beacons,
+// so it is computed once per epoch
+type layoutCache struct {
+	lock   *sync.Mutex
+	epoch  int
+	groups [][]*Group
+}
+
+// SetPeers sets the directories, including this one, whose randomness
+// decides the group layout. They have to be in the same order the
+// servers are given them. Without peers, the layout is only served if
+// this is the only directory.
+func (d *Directory) SetPeers(addrs []string, certs [][]byte) {
+	d.pool = NewConnPool(d.tlsConfig)
+	for p, addr := range addrs {
+		d.pool.Pin(addr, certs[p])
+	}
+	d.peers = addrs
+}
+
+// seed computes the same seed as GetRandomness, from the beacons of
+// all the peers
+func (d *Directory) seed(epoch int) ([SEED_LEN]byte, error) {
+	if len(d.peers) == 0 {
+		out, _, _ := VRF(d.keyPair.Priv, beaconInput(epoch))
+		return combineBeacons([][]byte{out})
+	}
+
+	var seed [SEED_LEN]byte
+	outs := make([][]byte, len(d.peers))
+	var errs []string
+	for p, addr := range d.peers {
+		pub, err := d.peerKey(p, addr)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("directory %d: %v", p, err))
+			continue
+		}
+		var beacon Beacon
+		err = d.pool.Call(addr, "DirectoryRPC.Randomness", epoch, &beacon, POLL_TIMEOUT)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("directory %d: %v", p, err))
+			continue
+		}
+		if beacon.Epoch != epoch {
+			errs = append(errs, fmt.Sprintf("directory %d: beacon for epoch %d",
+				p, beacon.Epoch))
+			continue
+		}
+		outs[p], err = VerifyVRF(pub, beaconInput(epoch), beacon.Gamma, beacon.Proof)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("directory %d: %v", p, err))
+		}
+	}
+	if errs != nil {
+		return seed, fmt.Errorf("Missing %d of %d beacons: %s",
+			len(errs), len(d.peers), strings.Join(errs, "; "))
+	}
+	return combineBeacons(outs)
+}
+
+// the key of peer p: the committed one if there is one, or else
+// whatever the peer says
+func (d *Directory) peerKey(p int, addr string) (*PublicKey, error) {
+	if d.DirectoryKeys != nil {
+		if p >= len(d.DirectoryKeys) {
+			return nil, errors.New("No committed key")
+		}
+		return ParsePubKey(d.DirectoryKeys[p])
+	}
+	var key string
+	err := d.pool.Call(addr, "DirectoryRPC.Key", 0, &key, POLL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePubKey(key)
+}
+
+// canLayout is whether the directory can get every beacon the layout
+// depends on; with other directories but no peers, it would serve a
+// layout nobody uses
+func (d *Directory) canLayout() bool {
+	return len(d.peers) > 0 || d.config.numDirs() == 1
+}
+
+func (d *Directory) layout(dir *Directory) ([][]*Group, error) {
+	d.layouts.lock.Lock()
+	defer d.layouts.lock.Unlock()
+	if d.layouts.groups != nil && d.layouts.epoch == dir.Epoch {
+		return d.layouts.groups, nil
+	}
+
+	seed, err := d.seed(dir.Epoch)
+	if err != nil {
+		return nil, err
+	}
+	groups := GenerateGroups(seed, dir.NetType, dir.NumServers,
+		dir.NumGroups, dir.PerGroup, dir.NumLevels, loadServerKeys(dir.Keys))
+	d.layouts.epoch, d.layouts.groups = dir.Epoch, groups
+	return groups, nil
+}
+
+// layoutInput copies what layout reads, so it can run outside the
+// lock; the caller holds d.lock
+func (d *Directory) layoutInput() *Directory {
+	return &Directory{
+		SystemParameter: d.SystemParameter,
+		Epoch:           d.Epoch,
+		Keys:            append([]string{}, d.Keys...),
+	}
+}
+
+func (d *Directory) view() (*DirectoryView, error) {
+	// everything shared is copied under the lock, since registrations
+	// change the slices in place
+	d.lock.Lock()
+	version, status := d.version, d.status()
+	view := &DirectoryView{
+		APIVersion: API_VERSION,
+		Version:    version,
+		Status:     status,
+		Epoch:      d.Epoch,
+		Round:      d.Round,
+
+		Params:   d.SystemParameter,
+		Schedule: d.Schedule,
+
+		RoundKeys: make(map[int]string),
+	}
+	for round, key := range d.RoundKeys {
+		view.RoundKeys[round] = key
+	}
+	for id, key := range d.Keys {
+		if key != "" {
+			view.Servers = append(view.Servers,
+				ServerView{id, d.Servers[id], key})
+		}
+	}
+	for id, key := range d.TrusteeKeys {
+		if key != "" {
+			view.Trustees = append(view.Trustees,
+				ServerView{id, d.Trustees[id], key})
+		}
+	}
+	groupKeys := make([][]string, len(d.GroupKeys))
+	for level := range groupKeys {
+		groupKeys[level] = append([]string{}, d.GroupKeys[level]...)
+	}
+	dir := d.layoutInput()
+	d.lock.Unlock()
+
+	if status == REGISTERING || !d.canLayout() {
+		return view, nil
+	}
+	groups, err := d.layout(dir)
+	if err != nil {
+		return nil, err
+	}
+	for level := range groups {
+		for gid, group := range groups[level] {
+			view.Groups = append(view.Groups, GroupView{
+				Level:   level,
+				Gid:     gid,
+				Members: group.Members,
+				Key:     groupKeys[level][gid],
+			})
+		}
+	}
+	return view, nil
+}
+
+// writes v as JSON, signed by the directory
+func (d *Directory) serveSigned(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	signed := SignedView{
+		Directory: body,
+		Key:       DumpPubKey(d.keyPair.Pub),
+		Signature: Sign(d.keyPair.Priv, body).Hex(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&signed)
+}
+
+func (d *Directory) serveView(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	view, err := d.view()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	d.serveSigned(w, view)
+}
+
+func (d *Directory) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	d.serveSigned(w, d.config)
+}
+
+// Handler serves the signed directory view at /v1/directory, the
+// config it was started with at /v1/config, and the trustees' verdicts
+// on a round at /v1/verdicts?round=N
+func (d *Directory) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(fmt.Sprintf("/v%d/directory", API_VERSION), d.serveView)
+	mux.HandleFunc(fmt.Sprintf("/v%d/config", API_VERSION), d.serveConfig)
+	mux.HandleFunc(fmt.Sprintf("/v%d/verdicts", API_VERSION), d.serveVerdicts)
+	return mux
+}
+
+// ListenHTTP serves Handler on addr until the directory is closed
+func (d *Directory) ListenHTTP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	d.httpListener = l
+	if !d.canLayout() {
+		log.Println("No peers for the HTTP view; it leaves out the groups")
+	}
+	srv := &http.Server{
+		Handler:      d.Handler(),
+		ReadTimeout:  HTTP_READ_TIMEOUT,
+		WriteTimeout: MAX_POLL,
+	}
+	go srv.Serve(l)
+	return nil
+}
+
+// VerifyView checks signed against the directory key and decodes it
+func VerifyView(signed *SignedView, key *PublicKey) (*DirectoryView, error) {
+	sig, err := ParseSignature(signed.Signature)
+	if err != nil {
+		return nil, err
+	}
+	err = Verify(key, signed.Directory, sig)
+	if err != nil {
+		return nil, err
+	}
+	var view DirectoryView
+	err = json.Unmarshal(signed.Directory, &view)
+	if err != nil {
+		return nil, err
+	}
+	return &view, nil
+}
@@ -0,0 +1,181 @@
+package directory
+
+import (
+	"errors"
+	"time"
+)
+
+// Schedule fixes when each round takes submissions: round r opens
+// r*Period after Start and closes Window later. A zero Period means
+// there is no schedule, and every round is open as soon as its key is.
+type Schedule struct {
+	Start  time.Time
+	Period time.Duration
+	Window time.Duration
+}
+
+func (s Schedule) Open(round int) time.Time {
+	return s.Start.Add(time.Duration(round) * s.Period)
+}
+
+func (s Schedule) Close(round int) time.Time {
+	return s.Open(round).Add(s.Window)
+}
+
+// Next is the first round after round that is still open or yet to
+// open at now
+func (s Schedule) Next(round int, now time.Time) int {
+	next := round + 1
+	if s.Period == 0 || now.Before(s.Start) {
+		return next
+	}
+	current := int(now.Sub(s.Start) / s.Period)
+	if !now.Before(s.Close(current)) {
+		current++
+	}
+	if current > next {
+		next = current
+	}
+	return next
+}
+
+type RoundInfo struct {
+	Round int
+	Open  time.Time
+	Close time.Time
+	Key   string // the trustees' round key, empty until they register it
+}
+
+type RoundReply struct {
+	Info    *RoundInfo // nil if the wait expired first
+	Status  int
+	Version int
+}
+
+// SetSchedule starts the round schedule. A zero start picks the next
+// multiple of period, so directories started close together agree;
+// otherwise they all have to be given the same start.
+func (d *Directory) SetSchedule(start time.Time, period, window time.Duration) error {
+	if period < 0 || window < 0 || window > period {
+		return errors.New("Invalid round schedule")
+	}
+	if start.IsZero() && period > 0 {
+		start = time.Now().Truncate(period).Add(period)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.Schedule = Schedule{start.UTC(), period, window}
+	d.changed()
+	return nil
+}
+
+// StartSchedule starts the round schedule with the config's RoundStart,
+// unless the directory was restored with a schedule, which it keeps so
+// the rounds don't move under the participants
+func (d *Directory) StartSchedule(period, window time.Duration) (bool, error) {
+	d.lock.Lock()
+	restored := d.Schedule.Period > 0
+	d.lock.Unlock()
+	if restored {
+		return false, nil
+	}
+	start := d.config.RoundStart
+	if start.IsZero() && d.config.numDirs() > 1 {
+		return false, errors.New("Several directories need a RoundStart in the config")
+	}
+	return true, d.SetSchedule(start, period, window)
+}
+
+func (d *Directory) roundInfo(round int) RoundInfo {
+	info := RoundInfo{
+		Round: round,
+		Key:   d.RoundKeys[round],
+	}
+	if d.Schedule.Period > 0 {
+		info.Open = d.Schedule.Open(round)
+		info.Close = d.Schedule.Close(round)
+	}
+	return info
+}
+
+// a round is announced once it is open and, if there are trustees,
+// has a key
+func (d *Directory) announced(round int, now time.Time) bool {
+	if d.Schedule.Period > 0 && now.Before(d.Schedule.Open(round)) {
+		return false
+	}
+	return d.NumTrustees == 0 || d.RoundKeys[round] != ""
+}
+
+// roundRunning tells whether a round is underway at now, so the epoch
+// must not change yet: with trustees, the newest round with a key until
+// a trustee decides it; without, a round whose window is open
+func (d *Directory) roundRunning(now time.Time) bool {
+	round := -1
+	if d.Schedule.Period > 0 {
+		if now.Before(d.Schedule.Start) {
+			return false
+		}
+		round = int(now.Sub(d.Schedule.Start) / d.Schedule.Period)
+	} else {
+		for r := range d.RoundKeys {
+			if r > round {
+				round = r
+			}
+		}
+	}
+	if round < 0 {
+		return false
+	}
+	if d.NumTrustees > 0 {
+		return d.RoundKeys[round] != "" && len(d.verdicts[round]) == 0
+	}
+	return d.Schedule.Period > 0 && now.Before(d.Schedule.Close(round))
+}
+
+// RoundInfo returns the schedule and key of a round
+func (d *DirectoryRPC) RoundInfo(round *int, info *RoundInfo) error {
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	if *round < 0 {
+		return errors.New("Invalid round")
+	}
+	*info = d.d.roundInfo(*round)
+	return nil
+}
+
+// NextRound blocks until the first round after args.After that has
+// not closed yet is announced, or the timeout expires, and returns it
+// along with the current status and version. Passing -1 waits for the
+// first round.
+func (d *DirectoryRPC) NextRound(args *WaitArgs, reply *RoundReply) error {
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	deadline := time.Now().Add(pollTimeout(args.Timeout))
+	for {
+		// a round that closes before it gets its key is skipped
+		next := d.d.Schedule.Next(args.After, time.Now())
+		if d.d.announced(next, time.Now()) {
+			info := d.d.roundInfo(next)
+			reply.Info = &info
+			break
+		}
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			break
+		}
+		// wake up when the round opens or closes, if nothing else
+		// changes before
+		wait := d.d.Schedule.Open(next).Sub(time.Now())
+		if wait < 0 {
+			wait = d.d.Schedule.Close(next).Sub(time.Now())
+		}
+		if d.d.Schedule.Period == 0 || wait < 0 || wait > left {
+			wait = left
+		}
+		d.d.waitChange(d.d.version, wait)
+	}
+	reply.Status = d.d.status()
+	reply.Version = d.d.version
+	return nil
+}
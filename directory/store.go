@@ -0,0 +1,119 @@
+package directory
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+
+	. "github.com/kwonalbert/atom/atomrpc"
+	. "github.com/kwonalbert/atom/crypto"
+)
+
+// Everything a directory needs to keep serving the same epoch after a
+// restart. The nonces of unfinished token requests are not kept, so
+// those clients have to wait for the next round.
+type storedState struct {
+	Directory *Directory // only the exported fields
+	Key       HexKeyPair
+	TokenKey  HexKeyPair
+
+	Version   int
+	Frozen    bool
+	Joins     map[int]*Registration
+	Leaves    map[int]bool
+	RoundRegs map[int]map[int]*Registration
+
+	Clients map[int]string
+	Issued  map[int]map[int]int
+
+	Verdicts map[int]map[int]*Verdict
+}
+
+// save writes the state to the store; the caller holds d.lock
+func (d *Directory) save() {
+	if d.storePath == "" {
+		return
+	}
+
+	// the signatures were already checked
+	joins := make(map[int]*Registration)
+	for id, reg := range d.joins {
+		cp := *reg
+		cp.Sig = nil
+		joins[id] = &cp
+	}
+	clients := make(map[int]string)
+	for id, pub := range d.clients {
+		clients[id] = DumpPubKey(pub)
+	}
+
+	st := storedState{
+		Directory: d,
+		Key:       DumpKey(d.keyPair),
+		TokenKey:  DumpKey(d.tokenKey),
+
+		Version:   d.version,
+		Frozen:    d.frozen,
+		Joins:     joins,
+		Leaves:    d.leaves,
+		RoundRegs: d.roundRegs,
+
+		Clients: clients,
+		Issued:  d.issued,
+
+		Verdicts: d.verdicts,
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		log.Fatal("Could not marshal directory state:", err)
+	}
+
+	// write a new file and move it over the old one, so a crash
+	// never leaves a half written store
+	tmp := d.storePath + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		log.Fatal("Could not save directory state:", err)
+	}
+	err = os.Rename(tmp, d.storePath)
+	if err != nil {
+		log.Fatal("Could not save directory state:", err)
+	}
+}
+
+// load restores the state in the store, if there is one
+func (d *Directory) load() (bool, error) {
+	b, err := ioutil.ReadFile(d.storePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	st := storedState{Directory: d}
+	err = json.Unmarshal(b, &st)
+	if err != nil {
+		return false, err
+	}
+
+	d.keyPair = LoadKey(st.Key)
+	if st.TokenKey.Pub != "" {
+		d.tokenKey = LoadKey(st.TokenKey)
+	}
+	d.version = st.Version
+	d.frozen = st.Frozen
+	d.joins = st.Joins
+	d.leaves = st.Leaves
+	if st.RoundRegs != nil {
+		d.roundRegs = st.RoundRegs
+	}
+	d.issued = st.Issued
+	if st.Verdicts != nil {
+		d.verdicts = st.Verdicts
+	}
+	for id, pub := range st.Clients {
+		d.clients[id] = LoadPubKey(pub)
+	}
+	return true, nil
+}
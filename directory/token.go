@@ -0,0 +1,187 @@
+package directory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/kwonalbert/atom/atomrpc"
+	. "github.com/kwonalbert/atom/common"
+	. "github.com/kwonalbert/atom/crypto"
+)
+
+// how long a client has to send its blinded challenge before the
+// signing session is given to the next client
+const TOKEN_SESSION_TIMEOUT = DEFAULT_TIMEOUT
+
+// Request for an anonymous submission token, signed by the client. A
+// client first asks for a signing commitment, then sends back its
+// blinded challenge C for the directory to sign.
+type TokenArgs struct {
+	Round int
+	Id    int     // client id
+	C     *Scalar // blinded challenge, for signing
+	Sig   *Signature
+}
+
+func (t *TokenArgs) message() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(t.Round))
+	binary.Write(buf, binary.LittleEndian, uint32(t.Id))
+	if t.C != nil {
+		b, _ := t.C.MarshalBinary()
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+func (t *TokenArgs) Sign(priv *PrivateKey) {
+	t.Sig = Sign(priv, t.message())
+}
+
+// A blind signing session. The directory runs one at a time, since
+// concurrent blind Schnorr sessions let clients forge more signatures
+// than they were given (the ROS attack).
+type tokenSession struct {
+	round int
+	id    int
+	k     *Scalar
+	timer *time.Timer
+}
+
+// The key a directory blindly signs tokens with. It is not the
+// directory's long-term key, so a client can't get a signature on a
+// snapshot out of it; Sig is by the long-term key.
+type TokenKey struct {
+	Key string
+	Sig *Signature
+}
+
+func tokenKeyMessage(key string) []byte {
+	return append([]byte("token-key"), key...)
+}
+
+func (t *TokenKey) Verify(dirKey *PublicKey) (*PublicKey, error) {
+	err := Verify(dirKey, tokenKeyMessage(t.Key), t.Sig)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePubKey(t.Key)
+}
+
+// check the request came from a registered client, and this directory
+// issues the round's tokens
+func (d *Directory) checkTokenArgs(args *TokenArgs) error {
+	if !d.Auth {
+		return errors.New("Directory does not issue tokens")
+	}
+	if TokenIssuer(args.Round, d.config.numDirs()) != d.id {
+		return fmt.Errorf("Directory %d does not issue tokens for round %d",
+			d.id, args.Round)
+	}
+	pub, ok := d.clients[args.Id]
+	if !ok {
+		return errors.New("Unregistered client")
+	}
+	return Verify(pub, args.message(), args.Sig)
+}
+
+// endSession lets the next session start, unless s already ended;
+// requires lock
+func (d *Directory) endSession(s *tokenSession) {
+	if d.session != s {
+		return
+	}
+	s.timer.Stop()
+	d.session = nil
+	<-d.sessions
+}
+
+func (d *DirectoryRPC) TokenKey(_ *int, key *TokenKey) error {
+	key.Key = DumpPubKey(d.d.tokenKey.Pub)
+	key.Sig = Sign(d.d.keyPair.Priv, tokenKeyMessage(key.Key))
+	return nil
+}
+
+// Only clients with approved keys can register, each key once, so no
+// one gets tokens under several ids
+func (d *DirectoryRPC) RegisterClient(reg *Registration, _ *int) error {
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	err := checkRegistration(reg, d.d.clientKeys, reg.message())
+	if err != nil {
+		return err
+	}
+	for id, key := range d.d.clients {
+		if DumpPubKey(key) == reg.Key && id != reg.Id {
+			return errors.New("Key already registered")
+		} else if id == reg.Id && DumpPubKey(key) != reg.Key {
+			return errors.New("Client already registered")
+		}
+	}
+	d.d.clients[reg.Id], _ = ParsePubKey(reg.Key)
+	d.d.save()
+	return nil
+}
+
+// Each client gets at most NumMsgs tokens per round, one for every
+// msg. Waits for the open session, if any, to end.
+func (d *DirectoryRPC) TokenCommit(args *TokenArgs, R *Point) error {
+	d.d.lock.Lock()
+	err := d.d.checkTokenArgs(args)
+	d.d.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case d.d.sessions <- true:
+	case <-time.After(TOKEN_SESSION_TIMEOUT):
+		return errors.New("Token signer busy")
+	}
+
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	if _, ok := d.d.issued[args.Round]; !ok {
+		d.d.issued[args.Round] = make(map[int]int)
+	}
+	issued := d.d.issued[args.Round][args.Id]
+	if issued >= d.d.NumMsgs {
+		<-d.d.sessions
+		return errors.New("Too many tokens requested")
+	}
+	// counted now, so abandoned sessions count too
+	d.d.issued[args.Round][args.Id] = issued + 1
+	d.d.save()
+
+	k, commit := BlindCommit()
+	s := &tokenSession{round: args.Round, id: args.Id, k: k}
+	s.timer = time.AfterFunc(TOKEN_SESSION_TIMEOUT, func() {
+		d.d.lock.Lock()
+		defer d.d.lock.Unlock()
+		d.d.endSession(s)
+	})
+	d.d.session = s
+	*R = *commit
+	return nil
+}
+
+func (d *DirectoryRPC) TokenSign(args *TokenArgs, sig *Scalar) error {
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	err := d.d.checkTokenArgs(args)
+	if err != nil {
+		return err
+	}
+
+	s := d.d.session
+	if s == nil || s.round != args.Round || s.id != args.Id || args.C == nil {
+		return errors.New("No matching token commitment")
+	}
+	// the commitment is only good for one signature
+	d.d.endSession(s)
+	*sig = *BlindSign(d.d.tokenKey.Priv, s.k, args.C)
+	return nil
+}
@@ -0,0 +1,84 @@
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	. "github.com/kwonalbert/atom/atomrpc"
+	. "github.com/kwonalbert/atom/crypto"
+)
+
+// RegisterVerdict records a trustee's signed verdict on a round, so
+// anyone can later check what each trustee decided and why. Verdicts
+// are not part of the signed directory, since the trustees decide at
+// different times.
+func (d *DirectoryRPC) RegisterVerdict(verdict *Verdict, _ *int) error {
+	d.d.lock.Lock()
+	defer d.d.lock.Unlock()
+	if verdict.Trustee < 0 || verdict.Trustee >= len(d.d.TrusteeKeys) ||
+		d.d.TrusteeKeys[verdict.Trustee] == "" {
+		return errors.New("Unknown trustee")
+	}
+	pub, err := ParsePubKey(d.d.TrusteeKeys[verdict.Trustee])
+	if err != nil {
+		return err
+	}
+	err = verdict.Verify(pub)
+	if err != nil {
+		return err
+	}
+
+	verdicts, ok := d.d.verdicts[verdict.Round]
+	if !ok {
+		verdicts = make(map[int]*Verdict)
+		d.d.verdicts[verdict.Round] = verdicts
+	}
+	if old, ok := verdicts[verdict.Trustee]; ok {
+		if old.Sig.Hex() != verdict.Sig.Hex() {
+			return fmt.Errorf("Trustee %d already decided round %d",
+				verdict.Trustee, verdict.Round)
+		}
+		return nil
+	}
+	verdicts[verdict.Trustee] = verdict
+	d.d.save()
+	return nil
+}
+
+// roundVerdicts returns the verdicts on round, by trustee id
+func (d *Directory) roundVerdicts(round int) []*Verdict {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var ids []int
+	for id := range d.verdicts[round] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	verdicts := make([]*Verdict, len(ids))
+	for i, id := range ids {
+		verdicts[i] = d.verdicts[round][id]
+	}
+	return verdicts
+}
+
+// Verdicts returns the verdicts registered for a round so far
+func (d *DirectoryRPC) Verdicts(round *int, verdicts *[]*Verdict) error {
+	*verdicts = d.d.roundVerdicts(*round)
+	return nil
+}
+
+func (d *Directory) serveVerdicts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	round, err := strconv.Atoi(r.URL.Query().Get("round"))
+	if err != nil {
+		http.Error(w, "Need a round", http.StatusBadRequest)
+		return
+	}
+	d.serveSigned(w, d.roundVerdicts(round))
+}
@@ -33,8 +33,6 @@ parser.add_argument('--mode', metavar='mode', type=int,
                     help='mode of operation')
 
 flags = vars(parser.parse_args(sys.argv[1:]))
-if flags['branch'] == -1:
-    flags['branch'] = flags['groups']
 
 aws = not flags['inst'] == ''
 
@@ -77,18 +75,36 @@ if aws:
     flag_db_addr = "--dbAddr %s:%d" % (root[0], flags['port'])
 flags['port'] += 1
 
-flag_num_clients = "--numClients %d" % flags['clients']
-flag_per_group = "--perGroup %d" % flags['gsize']
-flag_num_servers = "--numServers %d" % flags['servers']
-flag_num_groups = "--numGroups %d" % flags['groups']
-flag_num_trustees = "--numTrustees %d" % flags['trustees']
-flag_num_msgs = "--numMsgs %d" % flags['msgs']
-flag_msg_size = "--msgSize %d" % flags['msize']
-flag_mode = "--mode %d" % flags['mode']
-flag_net = "--net %d" % flags['type']
+# the directory reads the system parameters from a config file; on aws
+# it has to be copied over as well
+config = {
+    'Mode': flags['mode'],
+    'NetType': flags['type'],
+    'NumServers': flags['servers'],
+    'NumGroups': flags['groups'],
+    'PerGroup': flags['gsize'],
+    'NumTrustees': flags['trustees'],
+    'NumClients': flags['clients'],
+    'NumMsgs': flags['msgs'],
+    'MsgSize': flags['msize'],
+    'Threshold': max(flags['gsize']-1, 1),
+}
+config_file = "%s/src/%s/keys/config.json" % (gopath, src_dir)
+with open(config_file, 'w') as f:
+    json.dump(config, f)
+flag_config = "--config %s" % config_file
 flag_server_keys = "--keyFile %s/src/%s/keys/server_keys.json" % (gopath, src_dir)
 flag_trustee_keys = "--keyFile %s/src/%s/keys/trustee_keys.json" % (gopath, src_dir)
 
+# the directory and db create their certificates on first start; the
+# others pin them, so on aws these files have to be copied over
+dir_cert = "%s/src/%s/keys/directory_cert.pem" % (gopath, src_dir)
+db_cert = "%s/src/%s/keys/db_cert.pem" % (gopath, src_dir)
+flag_dir_tls = "--cert %s --tlsKey %s/src/%s/keys/directory_key.pem" % (dir_cert, gopath, src_dir)
+flag_db_tls = "--cert %s --tlsKey %s/src/%s/keys/db_key.pem" % (db_cert, gopath, src_dir)
+flag_dir_cert = "--dirCert %s" % dir_cert
+flag_db_cert = "--dbCert %s" % db_cert
+
 def localhost(c):
     os.system(c)
 
@@ -96,16 +112,8 @@ def remotehost(dest, c):
     os.system("ssh -o StrictHostKeyChecking=no -i ~/.ssh/emerald.pem %s '%s'" % (dest, c))
 
 dir_flags = " ".join([flag_dir_addr,
-                      flag_per_group,
-                      flag_num_servers,
-                      flag_num_clients,
-                      flag_num_groups,
-                      flag_num_trustees,
-                      flag_num_msgs,
-                      flag_msg_size,
-                      flag_mode,
-                      flag_net,
-                      flag_branch])
+                      flag_config,
+                      flag_dir_tls])
 c = '%s/bin/directory %s' % (gopath, dir_flags)
 if aws:
     directory = threading.Thread(target=remotehost, args=(root[0], c,))
@@ -115,7 +123,7 @@ directory.start()
 
 time.sleep(1)
 
-c = '%s/bin/db %s' % (gopath, flag_db_addr)
+c = '%s/bin/db %s %s' % (gopath, flag_db_addr, flag_db_tls)
 if aws:
     db = threading.Thread(target=remotehost, args=(root[0], c,))
 else :
@@ -131,6 +139,7 @@ for i in range(flags['trustees']):
     flags['port'] += 1
     trustee_flags = " ".join([flag_trustee_keys,
                               flag_dir_addr,
+                              flag_dir_cert,
                               flag_trustee_addr,
                               flag_id])
     c = '%s/bin/trustee %s' % (gopath, trustee_flags)
@@ -152,7 +161,9 @@ for i in range(flags['servers']):
     flag_id = "--id %d" % i
     serv_flags = " ".join([flag_server_keys,
                            flag_dir_addr,
+                           flag_dir_cert,
                            flag_db_addr,
+                           flag_db_cert,
                            flag_addr,
                            flag_id])
     c = '%s/bin/server %s' % (gopath, serv_flags)
@@ -170,7 +181,9 @@ cs = []
 for i in range(flags['clients']):
     flag_id = "--id %d" % i
     client_flags = " ".join([flag_dir_addr,
+                             flag_dir_cert,
                              flag_db_addr,
+                             flag_db_cert,
                              flag_id])
 
     c = '%s/bin/client %s' % (gopath, client_flags)
@@ -15,12 +15,3 @@ func selectGroup(inner InnerCiphertext, numGroups int) int {
 	binary.Read(bytes.NewBuffer(hash[:]), binary.LittleEndian, &gid)
 	return int(gid % uint64(numGroups))
 }
-
-func memberCommitment(comm Commitment, comms []Commitment) bool {
-	for c := range comms {
-		if comm == comms[c] {
-			return true
-		}
-	}
-	return false
-}
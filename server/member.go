@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"log"
 	"sync"
 
@@ -26,6 +27,11 @@ type Member struct {
 	collectBuf  map[int][]atomcrypto.Ciphertext
 	collectLock map[int]*sync.Cond
 
+	// how many ciphertexts each source sends in a round: every client
+	// at the entry level, every group of the level below otherwise
+	numSources int
+	sources    map[int]map[int]int
+
 	commitBuf  map[int][]atomcrypto.Commitment
 	commitLock map[int]*sync.Cond
 
@@ -37,9 +43,13 @@ type Member struct {
 
 	shufOld  map[int][]atomcrypto.Ciphertext
 	reencOld map[int][][]atomcrypto.Ciphertext
+
+	tokenLock *sync.Mutex
+	tokens    map[int]map[string]bool // round to spent token serials
 }
 
-func NewMember(sid int, key *atomcrypto.KeyPair, params SystemParameter, group *Group) *Member {
+func NewMember(sid int, key *atomcrypto.KeyPair, params SystemParameter,
+	group *Group, numSources int) *Member {
 	groupSize := len(group.Members)
 	useThreshold := params.Threshold < groupSize
 
@@ -73,6 +83,9 @@ func NewMember(sid int, key *atomcrypto.KeyPair, params SystemParameter, group *
 		collectBuf:  make(map[int][]atomcrypto.Ciphertext),
 		collectLock: make(map[int]*sync.Cond),
 
+		numSources: numSources,
+		sources:    make(map[int]map[int]int),
+
 		commitBuf:  make(map[int][]atomcrypto.Commitment),
 		commitLock: make(map[int]*sync.Cond),
 
@@ -84,6 +97,9 @@ func NewMember(sid int, key *atomcrypto.KeyPair, params SystemParameter, group *
 
 		shufOld:  make(map[int][]atomcrypto.Ciphertext),
 		reencOld: make(map[int][][]atomcrypto.Ciphertext),
+
+		tokenLock: new(sync.Mutex),
+		tokens:    make(map[int]map[string]bool),
 	}
 	return m
 }
@@ -99,29 +115,41 @@ func (m *Member) genMemberKey() {
 	m.group.GroupKey = groupKey
 }
 
+// ciphertexts waits until every source has said how many ciphertexts
+// it sends, and all of them are in
 func (m *Member) ciphertexts(round int) []atomcrypto.Ciphertext {
-	if m.params.Mode == TRAP_MODE {
-		m.collectLock[round].L.Lock()
-		for len(m.collectBuf[round]) < 2*m.params.NumMsgs {
-			m.collectLock[round].Wait()
-		}
-		m.collectLock[round].L.Unlock()
-	} else {
-		m.collectLock[round].L.Lock()
-		for len(m.collectBuf[round]) < m.params.NumMsgs {
-			m.collectLock[round].Wait()
-		}
-		m.collectLock[round].L.Unlock()
+	m.collectLock[round].L.Lock()
+	defer m.collectLock[round].L.Unlock()
+	for len(m.sources[round]) < m.numSources ||
+		len(m.collectBuf[round]) < m.expected(round) {
+		m.collectLock[round].Wait()
 	}
 	return m.collectBuf[round]
 }
 
-func (m *Member) commitWait(round int) {
-	m.commitLock[round].L.Lock()
-	for len(m.commitBuf[round]) < m.params.NumMsgs {
-		m.commitLock[round].Wait()
+// the ciphertexts the sources heard from so far send; the caller holds
+// the collect lock
+func (m *Member) expected(round int) int {
+	total := 0
+	for _, n := range m.sources[round] {
+		total += n
 	}
-	m.commitLock[round].L.Unlock()
+	return total
+}
+
+// expect records that source sends n ciphertexts in round
+func (m *Member) expect(round, source, n int) error {
+	m.collectLock[round].L.Lock()
+	defer m.collectLock[round].L.Unlock()
+	if _, ok := m.sources[round][source]; ok {
+		return fmt.Errorf("Source %d already sent to round %d", source, round)
+	}
+	if m.sources[round] == nil {
+		m.sources[round] = make(map[int]int)
+	}
+	m.sources[round][source] = n
+	m.collectLock[round].Broadcast()
+	return nil
 }
 
 func (m *Member) startRound(round int) {
@@ -150,17 +178,37 @@ func (m *Member) roundStarted(round int) bool {
 	return ok
 }
 
+// whether a token serial was used already
+func (m *Member) tokenSpent(round int, serial []byte) bool {
+	m.tokenLock.Lock()
+	defer m.tokenLock.Unlock()
+	return m.tokens[round][string(serial)]
+}
+
+// mark a token serial as used; false if it was already used
+func (m *Member) spendToken(round int, serial []byte) bool {
+	m.tokenLock.Lock()
+	defer m.tokenLock.Unlock()
+	if _, ok := m.tokens[round]; !ok {
+		m.tokens[round] = make(map[string]bool)
+	}
+	if m.tokens[round][string(serial)] {
+		return false
+	}
+	m.tokens[round][string(serial)] = true
+	return true
+}
+
 func (m *Member) collect(round int, id int, ciphertexts []atomcrypto.Ciphertext) {
 	m.collectLock[round].L.Lock()
 	m.collectBuf[round] = append(m.collectBuf[round], ciphertexts...)
-	m.collectLock[round].Signal()
+	m.collectLock[round].Broadcast()
 	m.collectLock[round].L.Unlock()
 }
 
 func (m *Member) collectCommitment(round int, id int, comms []atomcrypto.Commitment) {
 	m.commitLock[round].L.Lock()
 	m.commitBuf[round] = append(m.commitBuf[round], comms...)
-	m.commitLock[round].Signal()
 	m.commitLock[round].L.Unlock()
 }
 
@@ -196,10 +244,15 @@ func (m *Member) divide(cs []atomcrypto.Ciphertext) [][]atomcrypto.Ciphertext {
 		numNeighbors = 1 // last level, there are no neighbors
 	}
 	batches := make([][]atomcrypto.Ciphertext, numNeighbors)
-	// TODO: assumes even sized batches; make it more general
-	batchSize := len(cs) / numNeighbors
+	// the first len(cs)%numNeighbors batches get one more
+	start := 0
 	for b := range batches {
-		batches[b] = cs[b*batchSize : (b+1)*batchSize]
+		size := len(cs) / numNeighbors
+		if b < len(cs)%numNeighbors {
+			size++
+		}
+		batches[b] = cs[start : start+size]
+		start += size
 	}
 	return batches
 }
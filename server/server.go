@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -20,8 +21,12 @@ import (
 	. "github.com/kwonalbert/atom/crypto"
 )
 
+// how long to wait for this server to reach the epoch of another
+const EPOCH_TIMEOUT = time.Minute
+
 type ServerRPC struct {
-	s *Server
+	s    *Server
+	cert []byte // the caller's certificate
 }
 
 type Server struct {
@@ -33,6 +38,9 @@ type Server struct {
 
 	dirAddrs   []string
 	dirServers []*rpc.Client
+	dirKeys    []*PublicKey
+	tokenKeys  []*PublicKey // the directories' token issuing keys
+	quorum     int          // # of directories that must agree
 	dbServer   *rpc.Client
 	servers    []*rpc.Client
 	directory  *directory.Directory
@@ -40,12 +48,19 @@ type Server struct {
 
 	trustees []*rpc.Client
 
+	// round keys, fetched from the directories as rounds are opened
+	klock     *sync.Mutex
+	roundKeys map[int]*directory.RoundKey
+
+	// groups and connections of the current epoch
+	epoch   int
+	elock   *sync.RWMutex
+	ecnd    *sync.Cond // signalled when a new epoch is set up
 	network [][]*Group
 	partOf  [][]*Group
 	members map[int]*Member // maps a unique group id (not gid) to a member
 
-	keyPair   *KeyPair
-	connected *sync.WaitGroup
+	keyPair *KeyPair
 
 	listener net.Listener
 
@@ -57,7 +72,8 @@ type Server struct {
 }
 
 func NewServer(addr string, id int, keyFile string,
-	dirAddrs []string, dbAddr string) (*Server, error) {
+	dirAddrs []string, dirCerts [][]byte,
+	dbAddr string, dbCert []byte) (*Server, error) {
 	port, err := strconv.Atoi(strings.Split(addr, ":")[1])
 	if err != nil {
 		log.Fatal(err)
@@ -81,9 +97,12 @@ func NewServer(addr string, id int, keyFile string,
 		keyPair = LoadKey(serverKeys[id])
 	}
 
+	if len(dirCerts) != len(dirAddrs) {
+		return nil, errors.New("Need a certificate for every directory")
+	}
 	dirServers := make([]*rpc.Client, len(dirAddrs))
 	for d, dirAddr := range dirAddrs {
-		conn, err := tls.Dial("tcp", dirAddr, tlsConfig)
+		conn, err := DialPinned(dirAddr, tlsConfig, dirCerts[d])
 		if err != nil {
 			return nil, err
 		}
@@ -95,15 +114,12 @@ func NewServer(addr string, id int, keyFile string,
 		}
 	}
 
-	conn, err := tls.Dial("tcp", dbAddr, tlsConfig)
+	conn, err := DialPinned(dbAddr, tlsConfig, dbCert)
 	if err != nil {
 		return nil, err
 	}
 	dbServer := rpc.NewClient(conn)
 
-	connected := new(sync.WaitGroup)
-	connected.Add(1)
-
 	s := &Server{
 		id:   id,
 		addr: addr,
@@ -112,16 +128,21 @@ func NewServer(addr string, id int, keyFile string,
 		dirAddrs:   dirAddrs,
 		dbServer:   dbServer,
 		dirServers: dirServers,
+		quorum:     len(dirAddrs),
 
-		keyPair: keyPair,
+		elock: new(sync.RWMutex),
+
+		klock:     new(sync.Mutex),
+		roundKeys: make(map[int]*directory.RoundKey),
 
-		connected: connected,
+		keyPair: keyPair,
 
 		tlsCert:   tlsCert,
 		tlsConfig: tlsConfig,
 
 		slock: new(sync.Mutex),
 	}
+	s.ecnd = sync.NewCond(s.elock.RLocker())
 
 	return s, nil
 }
@@ -132,17 +153,24 @@ func (s *Server) Setup() {
 		log.Println("Registered server")
 	}
 
-	s.getDirectory()
+	s.accept()
 	if s.id == 0 {
-		log.Println("Got directory")
+		log.Println("Server started")
 	}
 
-	s.accept()
+	s.setupEpoch()
+	go s.watchEpochs()
+}
+
+// setupEpoch builds this server's groups for the current epoch of the
+// directory, and generates their keys
+func (s *Server) setupEpoch() {
+	s.getDirectory()
 	if s.id == 0 {
-		log.Println("Server started")
+		log.Println("Got directory for epoch", s.directory.Epoch)
 	}
 
-	s.connectServers()
+	s.genGroups()
 	if s.id == 0 {
 		log.Println("Connected servers")
 	}
@@ -158,15 +186,109 @@ func (s *Server) Setup() {
 	}
 }
 
+// watchEpochs sets up the groups again whenever the directories move
+// to a new epoch
+func (s *Server) watchEpochs() {
+	for {
+		s.elock.RLock()
+		epoch := s.epoch
+		s.elock.RUnlock()
+
+		_, err := directory.WaitEpoch(s.dirServers, epoch)
+		if err == rpc.ErrShutdown {
+			return
+		} else if err != nil {
+			log.Println("Epoch err:", err)
+			time.Sleep(DEFAULT_TIMEOUT)
+			continue
+		}
+		s.setupEpoch()
+	}
+}
+
+// member returns this server's member of group gid at level in the
+// current epoch, or nil if it is not in the group
+func (s *Server) member(level, gid int) *Member {
+	s.elock.RLock()
+	defer s.elock.RUnlock()
+	if level < 0 || level >= len(s.partOf) ||
+		gid < 0 || gid >= len(s.partOf[level]) ||
+		s.partOf[level][gid] == nil {
+		return nil
+	}
+	return s.members[s.partOf[level][gid].Uid]
+}
+
+// memberByUid waits until the group with uid is set up on this server,
+// since other members may move to a new epoch first, but only for so
+// long, since the uid may be in no epoch of this server at all
+func (s *Server) memberByUid(uid int) (*Member, error) {
+	s.elock.RLock()
+	defer s.elock.RUnlock()
+	s.waitEpoch(func() bool { return s.members[uid] != nil })
+	if s.members[uid] == nil {
+		return nil, fmt.Errorf("Not a member of group %d", uid)
+	}
+	return s.members[uid], nil
+}
+
+// waitEpoch waits until ok holds, or EPOCH_TIMEOUT passes without a
+// new epoch making it hold; the caller holds elock for reading
+func (s *Server) waitEpoch(ok func() bool) {
+	expired := false
+	timer := time.AfterFunc(EPOCH_TIMEOUT, func() {
+		s.elock.Lock()
+		expired = true
+		s.elock.Unlock()
+		s.ecnd.Broadcast()
+	})
+	defer timer.Stop()
+	for !ok() && !expired {
+		s.ecnd.Wait()
+	}
+}
+
+func (s *Server) server(id int) *rpc.Client {
+	s.elock.RLock()
+	defer s.elock.RUnlock()
+	return s.servers[id]
+}
+
+func (s *Server) groups(level int) []*Group {
+	s.elock.RLock()
+	defer s.elock.RUnlock()
+	return s.network[level]
+}
+
+// Set how many directories have to agree on a snapshot;
+// defaults to all of them
+func (s *Server) SetQuorum(quorum int) {
+	s.quorum = quorum
+}
+
 func (s *Server) Close() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
 
+	s.elock.RLock()
+	reg := &directory.Registration{
+		Epoch: s.epoch,
+		Id:    s.id,
+		Key:   DumpPubKey(s.keyPair.Pub),
+	}
+	s.elock.RUnlock()
+	reg.SignLeave(s.keyPair.Priv)
 	for _, dirServer := range s.dirServers {
+		err := dirServer.Call("DirectoryRPC.Leave", reg, nil)
+		if err != nil {
+			log.Println("Leave err:", err)
+		}
 		dirServer.Close()
 	}
 
+	s.elock.RLock()
+	defer s.elock.RUnlock()
 	for _, serv := range s.servers {
 		if serv != nil {
 			serv.Close()
@@ -175,27 +297,67 @@ func (s *Server) Close() {
 }
 
 func (s *Server) accept() {
-	l, e := tls.Listen("tcp", fmt.Sprintf(":%d", s.port), s.tlsConfig)
+	l, e := tls.Listen("tcp", fmt.Sprintf(":%d", s.port), PeerConfig(s.tlsConfig))
 	if e != nil {
 		log.Fatal("listen error:", e)
 	}
 	s.listener = l
 
-	rpcServer := rpc.NewServer()
-	rpcServer.Register(&ServerRPC{s})
-	go rpcServer.Accept(l)
+	go ServeWithCert(l, func(cert []byte) *rpc.Server {
+		rpcServer := rpc.NewServer()
+		rpcServer.Register(&ServerRPC{s, cert})
+		return rpcServer
+	})
+}
+
+// check the caller is a server of the current epoch; clients can only
+// submit. A server that is not in it may be in a new epoch this server
+// has not set up yet, so it is given until EPOCH_TIMEOUT to do so.
+func (s *ServerRPC) peer() error {
+	s.s.elock.RLock()
+	defer s.s.elock.RUnlock()
+	s.s.waitEpoch(s.known)
+	if s.s.directory == nil {
+		return errors.New("No directory yet")
+	} else if !s.known() {
+		return errors.New("Caller is not a server")
+	}
+	return nil
+}
+
+// whether the caller is a server of the current epoch; the caller
+// holds elock
+func (s *ServerRPC) known() bool {
+	if s.s.directory == nil {
+		return false
+	}
+	for _, chain := range s.s.directory.Certificates {
+		leaf := Leaf(chain)
+		if leaf != nil && bytes.Equal(leaf, s.cert) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Server) registerServer() {
 	pub := DumpPubKey(s.keyPair.Pub)
 	for _, dirServer := range s.dirServers {
+		// registrations are only good for the epoch they are made in
+		var epoch int
+		err := dirServer.Call("DirectoryRPC.Epoch", 0, &epoch)
+		if err != nil {
+			log.Fatal("Epoch err:", err)
+		}
 		reg := &directory.Registration{
+			Epoch:       epoch,
 			Addr:        s.addr,
 			Id:          s.id,
 			Key:         pub,
 			Certificate: s.tlsCert.Certificate,
 		}
-		err := dirServer.Call("DirectoryRPC.Register", reg, nil)
+		reg.Sign(s.keyPair.Priv)
+		err = dirServer.Call("DirectoryRPC.Register", reg, nil)
 		if err != nil {
 			log.Fatal("Register err:", err)
 		}
@@ -203,52 +365,105 @@ func (s *Server) registerServer() {
 }
 
 func (s *Server) getDirectory() {
-	s.directory, s.params, s.publicKeys = directory.GetDirectory(s.dirServers)
-	if s.params.Mode == TRAP_MODE {
+	if s.dirKeys == nil {
+		s.dirKeys = directory.GetKeys(s.dirServers)
+	}
+	dir, params, publicKeys, err := directory.GetDirectory(s.dirServers,
+		s.dirKeys, s.quorum)
+	if err != nil {
+		log.Fatal("Directory err:", err)
+	}
+	s.elock.Lock()
+	s.directory, s.params, s.publicKeys = dir, params, publicKeys
+	s.elock.Unlock()
+	// wakes up the calls from servers of this epoch
+	s.ecnd.Broadcast()
+
+	if s.params.Auth && s.tokenKeys == nil {
+		s.tokenKeys, err = directory.GetTokenKeys(s.dirServers, s.dirKeys)
+		if err != nil {
+			log.Fatal("Token key err:", err)
+		}
+	}
+
+	// the trustees don't change across epochs
+	if s.params.Mode == TRAP_MODE && s.trustees == nil {
 		s.trustees = make([]*rpc.Client, len(s.directory.Trustees))
 		for t, tAddr := range s.directory.Trustees {
-			conn, err := tls.Dial("tcp", tAddr, s.tlsConfig)
+			// only TrusteeThreshold of them have to be up
+			conn, err := DialPinned(tAddr, s.tlsConfig,
+				Leaf(s.directory.TrusteeCerts[t]))
 			if err != nil {
-				log.Fatal("Could not dial trustee")
+				log.Println("Could not dial trustee", t, ":", err)
+				continue
 			}
 			s.trustees[t] = rpc.NewClient(conn)
 		}
 	}
-	s.genGroups()
 }
 
+// genGroups generates the groups of the epoch, connects to the other
+// servers in them, and then switches this server over to them
 func (s *Server) genGroups() {
-	var seed [SEED_LEN]byte
-	for _, dirServer := range s.dirServers {
-		var val [SEED_LEN]byte
-		err := dirServer.Call("DirectoryRPC.Randomness", 0, &val)
-		if err != nil {
-			log.Fatal("Randomness err:", err)
-		}
-		Xor(val[:], seed[:])
+	seed, err := directory.GetRandomness(s.dirServers, s.dirKeys,
+		s.directory.Epoch)
+	if err != nil {
+		log.Fatal("Randomness err:", err)
 	}
 	network := GenerateGroups(seed, s.params.NetType, s.params.NumServers,
 		s.params.NumGroups, s.params.PerGroup,
 		s.params.NumLevels, s.publicKeys)
-	s.network = network
 
-	s.partOf = make([][]*Group, len(network))
-	s.members = make(map[int]*Member)
-	for level := range s.partOf {
-		s.partOf[level] = make([]*Group, len(network[level]))
+	partOf := make([][]*Group, len(network))
+	members := make(map[int]*Member)
+	for level := range partOf {
+		partOf[level] = make([]*Group, len(network[level]))
 		for gid, node := range network[level] {
 			if !IsMember(s.id, node.Members) {
-				s.partOf[level][gid] = nil
+				partOf[level][gid] = nil
 				continue
 			}
 			group := network[level][gid]
-			s.partOf[level][gid] = group
-			s.members[group.Uid] = NewMember(s.id, s.keyPair,
-				s.params, group)
+			partOf[level][gid] = group
+			members[group.Uid] = NewMember(s.id, s.keyPair,
+				s.params, group, numSources(network, s.params, level, gid))
+		}
+	}
+	servers := s.connectServers(network, partOf)
+
+	s.elock.Lock()
+	old := s.servers
+	s.epoch = s.directory.Epoch
+	s.network, s.partOf, s.members = network, partOf, members
+	s.servers = servers
+	s.elock.Unlock()
+	s.ecnd.Broadcast()
+
+	for _, serv := range old {
+		if serv != nil {
+			serv.Close()
 		}
 	}
 }
 
+// numSources is how many sources send to group gid of level each
+// round: every client at the entry level, and otherwise every group of
+// the level below with gid as a neighbor
+func numSources(network [][]*Group, params SystemParameter, level, gid int) int {
+	if level == 0 {
+		return params.NumClients
+	}
+	n := 0
+	for _, group := range network[level-1] {
+		for _, neighbor := range group.AdjList {
+			if neighbor.Gid == gid {
+				n++
+			}
+		}
+	}
+	return n
+}
+
 func (s *Server) callGroup(servers []*rpc.Client, group *Group) []*rpc.Client {
 	// connect to everyone in this group
 	for _, member := range group.Members {
@@ -259,7 +474,8 @@ func (s *Server) callGroup(servers []*rpc.Client, group *Group) []*rpc.Client {
 		// all servers must be online during inital seup, so retry
 		retry := 1
 		for retry != 0 {
-			conn, err := tls.Dial("tcp", s.directory.Servers[member], s.tlsConfig)
+			conn, err := DialPinned(s.directory.Servers[member], s.tlsConfig,
+				Leaf(s.directory.Certificates[member]))
 			if err == nil {
 				retry = 0
 				servers[member] = rpc.NewClient(conn)
@@ -269,10 +485,10 @@ func (s *Server) callGroup(servers []*rpc.Client, group *Group) []*rpc.Client {
 	return servers
 }
 
-func (s *Server) connectServers() {
+func (s *Server) connectServers(network, partOf [][]*Group) []*rpc.Client {
 	servers := make([]*rpc.Client, s.params.NumServers)
-	for level := range s.partOf {
-		for _, group := range s.partOf[level] {
+	for level := range partOf {
+		for _, group := range partOf[level] {
 			if group == nil {
 				continue
 			}
@@ -285,12 +501,11 @@ func (s *Server) connectServers() {
 		}
 	}
 
-	for _, group := range s.network[len(s.network)-1] {
+	for _, group := range network[len(network)-1] {
 		s.callGroup(servers, group)
 	}
 
-	s.servers = servers
-	s.connected.Done()
+	return servers
 }
 
 func (s *Server) genMemberKeys() {
@@ -312,7 +527,7 @@ func (s *Server) genMemberKeys() {
 				}
 
 				var reply DealReply
-				err := s.servers[other].Call("ServerRPC.Deal", &args, &reply)
+				err := s.server(other).Call("ServerRPC.Deal", &args, &reply)
 				if err != nil {
 					log.Fatal("Deal fail:", err)
 				}
@@ -326,9 +541,11 @@ func (s *Server) genMemberKeys() {
 }
 
 func (s *Server) addDealSendResponse(args *DealArgs) {
-	s.connected.Wait()
-
-	member := s.members[args.Uid]
+	member, err := s.memberByUid(args.Uid)
+	if err != nil {
+		log.Println("Deal err:", err)
+		return
+	}
 	resp, err := member.share.AddDeal(args.Deal)
 	if err != nil {
 		log.Fatal("failed to add deal:")
@@ -344,7 +561,7 @@ func (s *Server) addDealSendResponse(args *DealArgs) {
 		}
 
 		var reply ResponseReply
-		err := s.servers[other].Call("ServerRPC.Response", &args, &reply)
+		err := s.server(other).Call("ServerRPC.Response", &args, &reply)
 		if err != nil {
 			log.Fatal("Deal fail:", err)
 		}
@@ -368,10 +585,13 @@ func (s *Server) setupGroupKeys() {
 			pub := DumpPubKey(group.GroupKey)
 			for _, dirServer := range s.dirServers {
 				reg := &directory.Registration{
-					Level: group.Level,
-					Id:    group.Gid,
-					Key:   pub,
+					Epoch:  s.epoch,
+					Level:  group.Level,
+					Member: s.id,
+					Id:     group.Gid,
+					Key:    pub,
 				}
+				reg.SignGroup(s.keyPair.Priv)
 				err := dirServer.Call("DirectoryRPC.RegisterGroup", reg, nil)
 				if err != nil {
 					log.Fatal("Register err:", err)
@@ -380,8 +600,19 @@ func (s *Server) setupGroupKeys() {
 		}
 	}
 
-	var keys [][]*PublicKey
-	s.directory, s.params, _, keys = directory.GetGroupKeys(s.dirServers)
+	dir, params, _, keys, err := directory.GetGroupKeys(s.dirServers,
+		s.dirKeys, s.quorum)
+	if err != nil {
+		log.Fatal("Directory err:", err)
+	}
+	if dir.Epoch != s.epoch {
+		// moved on already; the watcher sets up the new epoch
+		return
+	}
+
+	s.elock.Lock()
+	defer s.elock.Unlock()
+	s.directory, s.params = dir, params
 	for level := range keys {
 		for gid := range keys[level] {
 			s.network[level][gid].GroupKey = keys[level][gid]
@@ -390,17 +621,17 @@ func (s *Server) setupGroupKeys() {
 }
 
 func (s *Server) collect(args *CollectArgs) {
-	uid := s.partOf[args.Level][args.Gid].Uid
-	member := s.members[uid]
+	member := s.member(args.Level, args.Gid)
 
 	newArgs := &ShuffleArgs{
 		Ciphertexts: member.ciphertexts(args.Round),
 		ArgInfo:     args.ArgInfo,
 	}
 
-	// entry groups need to wait for commitments too
+	// entry groups have every client's commitments by now, and commit
+	// to them with the trustees
 	if s.params.Mode == TRAP_MODE && args.Level == 0 {
-		member.commitWait(args.Round)
+		s.reportEntry(member, args.Round, len(newArgs.Ciphertexts))
 	}
 
 	if args.Cur == member.idx {
@@ -413,8 +644,7 @@ func (s *Server) shuffle(args *ShuffleArgs) {
 		log.Println("shuffle:", args.ArgInfo)
 	}
 
-	uid := s.partOf[args.Level][args.Gid].Uid
-	member := s.members[uid]
+	member := s.member(args.Level, args.Gid)
 
 	// for NIZK mode, any server other than the first
 	// should collect ok from other servers
@@ -460,7 +690,7 @@ func (s *Server) shuffle(args *ShuffleArgs) {
 
 			next := member.group.Members[idx]
 			var reply ShuffleReply
-			err := AtomRPC(s.servers[next], "ServerRPC.VerifyShuffle",
+			err := AtomRPC(s.server(next), "ServerRPC.VerifyShuffle",
 				&newArgs, &reply, DEFAULT_TIMEOUT)
 			if err != nil {
 				log.Fatal("Verify shuffle request:", err)
@@ -485,7 +715,7 @@ func (s *Server) shuffle(args *ShuffleArgs) {
 		}
 
 		var reply ShuffleReply
-		err := AtomRPC(s.servers[next], "ServerRPC.Shuffle",
+		err := AtomRPC(s.server(next), "ServerRPC.Shuffle",
 			&newArgs, &reply, DEFAULT_TIMEOUT)
 		if err != nil {
 			log.Fatal("Shuffle request:", err)
@@ -501,7 +731,7 @@ func (s *Server) shuffle(args *ShuffleArgs) {
 		}
 
 		var reply ReencryptReply
-		err := AtomRPC(s.servers[next], "ServerRPC.Reencrypt",
+		err := AtomRPC(s.server(next), "ServerRPC.Reencrypt",
 			&newArgs, &reply, DEFAULT_TIMEOUT)
 		if err != nil {
 			log.Fatal("Reencrypt request:", err)
@@ -510,8 +740,7 @@ func (s *Server) shuffle(args *ShuffleArgs) {
 }
 
 func (s *Server) verifyShuffle(args *VerifyShuffleArgs) {
-	uid := s.partOf[args.Level][args.Gid].Uid
-	member := s.members[uid]
+	member := s.member(args.Level, args.Gid)
 
 	// TODO: also check args.Old == currently collected
 	ok := member.verifyShuffle(args.Old, args.New, args.Proof)
@@ -540,7 +769,7 @@ func (s *Server) verifyShuffle(args *VerifyShuffleArgs) {
 		ArgInfo: args.ArgInfo,
 	}
 	var reply ProofOKReply
-	err := AtomRPC(s.servers[next], "ServerRPC.ShuffleOK",
+	err := AtomRPC(s.server(next), "ServerRPC.ShuffleOK",
 		&newArgs, &reply, DEFAULT_TIMEOUT)
 	if err != nil {
 		log.Fatal("Shuffle ok request:", err)
@@ -552,8 +781,7 @@ func (s *Server) reencrypt(args *ReencryptArgs) {
 		log.Println("reencrypt:", args.ArgInfo)
 	}
 
-	uid := s.partOf[args.Level][args.Gid].Uid
-	member := s.members[uid]
+	member := s.member(args.Level, args.Gid)
 
 	priv := s.keyPair.Priv
 	if member.share != nil {
@@ -613,7 +841,7 @@ func (s *Server) reencrypt(args *ReencryptArgs) {
 
 			next := member.group.Members[idx]
 			var reply ShuffleReply
-			err := AtomRPC(s.servers[next], "ServerRPC.VerifyReencrypt",
+			err := AtomRPC(s.server(next), "ServerRPC.VerifyReencrypt",
 				&newArgs, &reply, DEFAULT_TIMEOUT)
 			if err != nil {
 				log.Fatal("Verify reencrypt request:", err)
@@ -628,7 +856,7 @@ func (s *Server) reencrypt(args *ReencryptArgs) {
 		}
 
 		var reply ShuffleReply
-		err := AtomRPC(s.servers[next], "ServerRPC.Reencrypt",
+		err := AtomRPC(s.server(next), "ServerRPC.Reencrypt",
 			&newArgs, &reply, DEFAULT_TIMEOUT)
 		if err != nil {
 			log.Fatal(err)
@@ -654,7 +882,7 @@ func (s *Server) reencrypt(args *ReencryptArgs) {
 			}
 			for _, other := range member.group.Members {
 				var reply FinalizeReply
-				err := AtomRPC(s.servers[other], "ServerRPC.Finalize",
+				err := AtomRPC(s.server(other), "ServerRPC.Finalize",
 					&newArgs, &reply, DEFAULT_TIMEOUT)
 				if err != nil {
 					log.Fatal(err)
@@ -678,9 +906,10 @@ func (s *Server) reencrypt(args *ReencryptArgs) {
 				trapDivs[gid] = append(trapDivs[gid], traps[t])
 			}
 
-			// the first layer servers are responsible for verifying
-			// since they know the commitments
-			for _, group := range s.network[0] {
+			// the trustees audit the traps, and the first layer
+			// servers verify them since they know the commitments
+			s.reportExit(member, args.Round, traps, innerDivs)
+			for _, group := range s.groups(0) {
 				info := ArgInfo{
 					Round: args.Round,
 					Level: 0,
@@ -696,7 +925,7 @@ func (s *Server) reencrypt(args *ReencryptArgs) {
 				for _, idx := range args.Group {
 					other := group.Members[idx]
 					var reply FinalizeReply
-					err := AtomRPC(s.servers[other], "ServerRPC.Finalize",
+					err := AtomRPC(s.server(other), "ServerRPC.Finalize",
 						&newArgs, &reply, DEFAULT_TIMEOUT)
 					if err != nil {
 						log.Fatal(err)
@@ -732,7 +961,7 @@ func (s *Server) reencrypt(args *ReencryptArgs) {
 				next := neighbor.Members[idx]
 
 				var reply ReencryptReply
-				err := AtomRPC(s.servers[next], "ServerRPC.Collect",
+				err := AtomRPC(s.server(next), "ServerRPC.Collect",
 					&newArgs, &reply, DEFAULT_TIMEOUT)
 				if err != nil {
 					log.Fatal(err)
@@ -743,8 +972,7 @@ func (s *Server) reencrypt(args *ReencryptArgs) {
 }
 
 func (s *Server) verifyReencrypt(args *VerifyReencryptArgs) {
-	uid := s.partOf[args.Level][args.Gid].Uid
-	member := s.members[uid]
+	member := s.member(args.Level, args.Gid)
 
 	// also check args.Old == currently collected
 	ok := member.verifyReencrypt(args.Old, args.New, args.Proofs)
@@ -764,7 +992,7 @@ func (s *Server) verifyReencrypt(args *VerifyReencryptArgs) {
 		ArgInfo: args.ArgInfo,
 	}
 	var reply ProofOKReply
-	err := AtomRPC(s.servers[next], "ServerRPC.ReencryptOK",
+	err := AtomRPC(s.server(next), "ServerRPC.ReencryptOK",
 		&newArgs, &reply, DEFAULT_TIMEOUT)
 	if err != nil {
 		log.Fatal(err)
@@ -776,8 +1004,7 @@ func (s *Server) finalize(args *FinalizeArgs) {
 		log.Println("finalize:", args.ArgInfo)
 	}
 
-	uid := s.partOf[args.Level][args.Gid].Uid
-	member := s.members[uid]
+	member := s.member(args.Level, args.Gid)
 	last := args.Group[len(args.Group)-1] == member.idx
 
 	if s.params.Mode == VER_MODE {
@@ -826,70 +1053,315 @@ func (s *Server) finalize(args *FinalizeArgs) {
 	expComms := member.commitments(args.Round)
 	correctTraps := len(expComms) == len(comms)
 	for _, comm := range expComms {
-		correctTraps = correctTraps && memberCommitment(comm, comms)
+		correctTraps = correctTraps && MemberCommitment(comm, comms)
 	}
 
 	// report to all trustees
 	newArgs := ReportArgs{
 		Round:        args.Round,
+		Epoch:        s.currentEpoch(),
 		Sid:          s.id,
-		Uid:          uid,
+		Uid:          member.group.Uid,
 		CorrectHash:  correctHash,
 		CorrectTraps: correctTraps,
 		NoDups:       noDups,
 		NumTraps:     len(traps),
 		NumMsgs:      len(inners),
+		Comms:        comms,
+		Rs:           make([]*Point, len(inners)),
 	}
+	for i := range inners {
+		newArgs.Rs[i] = inners[i].R
+	}
+	newArgs.Sign(s.keyPair.Priv)
+
+	plaintexts, err := s.openInners(&newArgs, inners)
+	if err != nil {
+		// the round's msgs are dropped, but the server keeps going
+		log.Println("Round", args.Round, "not opened for group",
+			member.group.Gid, ":", err)
+		return
+	}
+
+	dbArgs := DBArgs{
+		Round:     args.Round,
+		NumGroups: s.params.NumGroups,
+		Msgs:      plaintexts,
+	}
+	err = s.dbServer.Call("DB.Write", dbArgs, nil)
+	if err != nil {
+		log.Fatal("DB Write error:", err)
+	}
+
+	if member.idx == args.Group[0] {
+		log.Println("Done with group", member.group.Gid, ":", time.Since(s.start), ". #msgs: ", s.params.NumMsgs)
+	}
+}
+
+func (s *Server) currentEpoch() int {
+	s.elock.RLock()
+	defer s.elock.RUnlock()
+	return s.epoch
+}
 
-	privs := make([]*PrivateKey, len(s.trustees))
+// call method on every connected trustee, logging the failures
+func (s *Server) tellTrustees(method string, args interface{}) {
 	for t, trustee := range s.trustees {
-		var reply ReportReply
-		err := trustee.Call("TrusteeRPC.Report", &newArgs, &reply)
+		if trustee == nil {
+			continue
+		}
+		err := trustee.Call(method, args, nil)
 		if err != nil {
-			log.Fatal("Could not get keys from trustee:", err)
+			log.Println("Trustee", t, "err:", err)
 		}
-		privs[t] = reply.Priv
 	}
-	priv := CombinePrivateKeys(privs)
-	pub := LoadPubKey(s.directory.RoundKeys[args.Round])
+}
 
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.LittleEndian, uint32(args.Round))
+// reportEntry commits to the trap commitments the entry group got,
+// along with how many ciphertexts came with them
+func (s *Server) reportEntry(member *Member, round, numMsgs int) {
+	comms := member.commitments(round)
+	report := EntryReport{
+		Round:    round,
+		Epoch:    s.currentEpoch(),
+		Sid:      s.id,
+		Uid:      member.group.Uid,
+		Traps:    CommitSet(comms),
+		NumTraps: len(comms),
+		NumMsgs:  numMsgs,
+	}
+	report.Sign(s.keyPair.Priv)
+	s.tellTrustees("TrusteeRPC.EntryReport", &report)
+}
+
+// reportExit publishes the traps the exit group recovered, and the
+// real messages it sends to each entry group
+func (s *Server) reportExit(member *Member, round int, traps []Trap,
+	innerDivs [][]InnerCiphertext) {
+	report := ExitReport{
+		Round: round,
+		Epoch: s.currentEpoch(),
+		Sid:   s.id,
+		Uid:   member.group.Uid,
+		Traps: traps,
+		Rs:    make([][]*Point, len(innerDivs)),
+	}
+	for gid, inners := range innerDivs {
+		report.Rs[gid] = make([]*Point, len(inners))
+		for i := range inners {
+			report.Rs[gid][i] = inners[i].R
+		}
+	}
+	report.Sign(s.keyPair.Priv)
+	s.tellTrustees("TrusteeRPC.ExitReport", &report)
+}
+
+// openInners reports to all trustees, and opens inners with the
+// partial decryptions of the first TrusteeThreshold trustees whose
+// proofs check out
+func (s *Server) openInners(report *ReportArgs, inners []InnerCiphertext) ([][]byte, error) {
+	rk, err := s.roundKey(report.Round)
 	if err != nil {
-		log.Fatal("Could not write round")
+		return nil, err
+	}
+	commits := rk.Commits
+
+	type partial struct {
+		t     int
+		reply ReportReply
+		err   error
+	}
+	partials := make(chan partial, len(s.trustees))
+	for t, trustee := range s.trustees {
+		if trustee == nil {
+			partials <- partial{t, ReportReply{}, errors.New("Not connected")}
+			continue
+		}
+		go func(t int, trustee *rpc.Client) {
+			var reply ReportReply
+			err := trustee.Call("TrusteeRPC.Report", report, &reply)
+			if err == nil {
+				err = s.checkVerdict(t, report.Round, reply.Verdict)
+			}
+			if err == nil {
+				err = checkPartials(PublicShare(commits, t), report.Rs, &reply)
+			}
+			partials <- partial{t, reply, err}
+		}(t, trustee)
 	}
-	nonce := buf.Bytes()
 
-	plaintexts := make([][]byte, len(inners))
+	var group []int
+	var replies []ReportReply
+	for range s.trustees {
+		p := <-partials
+		if p.err != nil {
+			log.Println("Trustee", p.t, "err:", p.err)
+			continue
+		}
+		group = append(group, p.t)
+		replies = append(replies, p.reply)
+		if len(group) == s.params.TrusteeThreshold {
+			break
+		}
+	}
+	if len(group) < s.params.TrusteeThreshold {
+		return nil, errors.New("Not enough trustees released the round")
+	}
+
+	pub := rk.Key
+	nonce := roundNonce(report.Round)
+	var plaintexts [][]byte
 	for i := range inners {
-		plaintexts[i], err = CCA2Decrypt(inners[i], nonce, priv, pub)
+		shares := make([]*Point, len(group))
+		for t := range group {
+			shares[t] = replies[t].Partials[i]
+		}
+		shared := CombinePartials(group, shares)
+		plaintext, err := CCA2DecryptShared(inners[i], nonce, shared, pub)
 		if err != nil {
-			log.Fatal("CCA2 Decrypt fail:", err)
+			// a client's bad ciphertext only loses its own msg
+			log.Println("CCA2 Decrypt fail:", err)
+			continue
 		}
+		plaintexts = append(plaintexts, plaintext)
 	}
+	return plaintexts, nil
+}
 
-	dbArgs := DBArgs{
-		Round:     args.Round,
-		NumGroups: s.params.NumGroups,
-		Msgs:      plaintexts,
+// how many rounds' keys a server keeps around
+const KEEP_ROUND_KEYS = 4
+
+// roundKey returns the key of round as a quorum of the directories has
+// it; the directory snapshot only has the keys of its epoch's first
+// rounds
+func (s *Server) roundKey(round int) (*directory.RoundKey, error) {
+	s.klock.Lock()
+	defer s.klock.Unlock()
+	if rk, ok := s.roundKeys[round]; ok {
+		return rk, nil
 	}
-	err = s.dbServer.Call("DB.Write", dbArgs, nil)
+	rk, err := directory.GetRoundKey(s.dirServers, s.quorum, round)
 	if err != nil {
-		log.Fatal("DB Write error:", err)
+		return nil, err
+	}
+	s.roundKeys[round] = rk
+	for r := range s.roundKeys {
+		if r <= round-KEEP_ROUND_KEYS {
+			delete(s.roundKeys, r)
+		}
 	}
+	return rk, nil
+}
 
-	if member.idx == args.Group[0] {
-		log.Println("Done with group", member.group.Gid, ":", time.Since(s.start), ". #msgs: ", s.params.NumMsgs)
+// check trustee t signed a verdict releasing round
+func (s *Server) checkVerdict(t, round int, verdict *Verdict) error {
+	if verdict == nil || verdict.Trustee != t || verdict.Round != round {
+		return errors.New("Missing verdict")
+	}
+	err := verdict.Verify(LoadPubKey(s.directory.TrusteeKeys[t]))
+	if err != nil {
+		return err
+	}
+	for _, m := range verdict.Missing {
+		log.Println("Trustee", t, "got no reports from", m.Sids,
+			"in group", m.Uid)
+	}
+	for _, f := range verdict.Findings {
+		log.Println("Trustee", t, "audit: group", f.Uid, "gid", f.Gid, ":", f.Reason)
+	}
+	if verdict.Decision != RELEASE {
+		return fmt.Errorf("Round withheld: %s", verdict.Reason)
+	}
+	return nil
+}
+
+// check a trustee's partial decryptions of Rs against its public share
+func checkPartials(share *PublicKey, Rs []*Point, reply *ReportReply) error {
+	if len(reply.Partials) != len(Rs) || len(reply.Proofs) != len(Rs) {
+		return errors.New("Wrong number of partial decryptions")
+	}
+	for i, R := range Rs {
+		err := VerifyDLEQ(share, R, reply.Partials[i], reply.Proofs[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the nonce used for CCA2 ciphertexts of a round
+func roundNonce(round int) []byte {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, uint32(round))
+	if err != nil {
+		log.Fatal("Could not write round")
+	}
+	return buf.Bytes()
+}
+
+// check that a submission carries a token from the round's issuer for
+// a single msg, plus its trap in trap mode
+func (s *Server) checkToken(args *SubmitArgs) error {
+	perToken := 1
+	if s.params.Mode == TRAP_MODE {
+		perToken = 2
+	}
+	if len(args.Ciphertexts) != perToken {
+		return errors.New("One message per token")
+	}
+	return s.verifyToken(args.Round, args.Gid, args.Token)
+}
+
+// check that a token is from the round's issuer, for round and gid
+func (s *Server) verifyToken(round, gid int, token *Token) error {
+	if token == nil {
+		return errors.New("Missing submission token")
+	}
+	if token.Dir != TokenIssuer(round, len(s.dirKeys)) {
+		return errors.New("Token not from the round's issuer")
+	}
+	msg := TokenMessage(round, gid, token.Serial)
+	return VerifyBlind(s.tokenKeys[token.Dir], msg, token.Sig)
+}
+
+// check that a commitment carries a distinct, unspent token for every
+// msg it announces; it does not spend them, the submissions do
+func (s *Server) checkCommitTokens(member *Member, args *CommitArgs) error {
+	if len(args.Tokens) != args.NumMsgs {
+		return errors.New("Need a token for every msg")
+	}
+	serials := make(map[string]bool)
+	for _, token := range args.Tokens {
+		err := s.verifyToken(args.Round, args.Gid, token)
+		if err != nil {
+			return err
+		}
+		if serials[string(token.Serial)] || member.tokenSpent(args.Round, token.Serial) {
+			return errors.New("Submission token already used")
+		}
+		serials[string(token.Serial)] = true
 	}
+	return nil
 }
 
 func (s *ServerRPC) Deal(args *DealArgs, _ *DealReply) error {
+	err := s.peer()
+	if err != nil {
+		return err
+	}
 	go s.s.addDealSendResponse(args)
 	return nil
 }
 
 func (s *ServerRPC) Response(args *ResponseArgs, _ *ResponseReply) error {
-	member := s.s.members[args.Uid]
+	err := s.peer()
+	if err != nil {
+		return err
+	}
+	member, err := s.s.memberByUid(args.Uid)
+	if err != nil {
+		return err
+	}
 	return member.share.AddResponse(args.Resp)
 }
 
@@ -900,8 +1372,17 @@ func (s *ServerRPC) Submit(args *SubmitArgs, _ *SubmitReply) error {
 		s.s.slock.Unlock()
 	}
 
-	uid := s.s.partOf[args.Level][args.Gid].Uid
-	member := s.s.members[uid]
+	member := s.s.member(args.Level, args.Gid)
+	if member == nil {
+		return errors.New("Not a member of the group")
+	}
+
+	if s.s.params.Auth {
+		err := s.s.checkToken(args)
+		if err != nil {
+			return err
+		}
+	}
 
 	for c := range args.Ciphertexts {
 		err := VerifyEncrypt(member.group.GroupKey,
@@ -911,6 +1392,11 @@ func (s *ServerRPC) Submit(args *SubmitArgs, _ *SubmitReply) error {
 		}
 	}
 
+	// spent only now, so a bad submission does not burn the token
+	if s.s.params.Auth && !member.spendToken(args.Round, args.Token.Serial) {
+		return errors.New("Submission token already used")
+	}
+
 	if s.s.params.Mode == TRAP_MODE && member.idx != args.Cur {
 		// TODO: send the verification result to all servers
 		return nil
@@ -932,8 +1418,27 @@ func (s *ServerRPC) Submit(args *SubmitArgs, _ *SubmitReply) error {
 }
 
 func (s *ServerRPC) Commit(args *CommitArgs, _ *CommitReply) error {
-	uid := s.s.partOf[args.Level][args.Gid].Uid
-	member := s.s.members[uid]
+	member := s.s.member(args.Level, args.Gid)
+	if member == nil {
+		return errors.New("Not a member of the group")
+	}
+	if args.Level != 0 || args.NumMsgs < 0 || args.NumMsgs > s.s.params.NumMsgs {
+		return errors.New("Invalid commitment")
+	}
+	// a trap, and its commitment, for every msg
+	numCiphertexts := args.NumMsgs
+	if s.s.params.Mode == TRAP_MODE {
+		if len(args.Comms) != args.NumMsgs {
+			return errors.New("Need a commitment for every msg")
+		}
+		numCiphertexts *= 2
+	}
+	if s.s.params.Auth {
+		err := s.s.checkCommitTokens(member, args)
+		if err != nil {
+			return err
+		}
+	}
 
 	started := member.roundStarted(args.Round)
 	if !started {
@@ -946,61 +1451,105 @@ func (s *ServerRPC) Commit(args *CommitArgs, _ *CommitReply) error {
 	}
 
 	member.collectCommitment(args.Round, args.Id, args.Comms)
-	return nil
+	return member.expect(args.Round, args.Id, numCiphertexts)
 }
 
 func (s *ServerRPC) Collect(args *CollectArgs, _ *CollectReply) error {
-	uid := s.s.partOf[args.Level][args.Gid].Uid
-	member := s.s.members[uid]
+	err := s.peer()
+	if err != nil {
+		return err
+	}
+	member := s.s.member(args.Level, args.Gid)
+	if member == nil {
+		return errors.New("Not a member of the group")
+	}
 
 	started := member.roundStarted(args.Round)
 	if !started {
 		member.startRound(args.Round)
 		go s.s.collect(args)
 	}
+	err = member.expect(args.Round, args.Id, len(args.Ciphertexts))
+	if err != nil {
+		return err
+	}
 	member.collect(args.Round, args.Id, args.Ciphertexts)
 	return nil
 }
 
 func (s *ServerRPC) Shuffle(args *ShuffleArgs, _ *ShuffleReply) error {
+	err := s.peer()
+	if err != nil {
+		return err
+	}
 	go s.s.shuffle(args)
 	return nil
 }
 
 func (s *ServerRPC) VerifyShuffle(args *VerifyShuffleArgs, _ *VerifyShuffleReply) error {
+	err := s.peer()
+	if err != nil {
+		return err
+	}
 	go s.s.verifyShuffle(args)
 	return nil
 }
 
 func (s *ServerRPC) ShuffleOK(args *ProofOKArgs, _ *ProofOKReply) error {
-	uid := s.s.partOf[args.Level][args.Gid].Uid
-	member := s.s.members[uid]
+	err := s.peer()
+	if err != nil {
+		return err
+	}
+	member := s.s.member(args.Level, args.Gid)
+	if member == nil {
+		return errors.New("Not a member of the group")
+	}
 	// TODO: actually check if the person sending this is the right server
 	member.queueShufOK(args.Round, args.OK)
 	return nil
 }
 
 func (s *ServerRPC) Reencrypt(args *ReencryptArgs, _ *ReencryptReply) error {
+	err := s.peer()
+	if err != nil {
+		return err
+	}
 	go s.s.reencrypt(args)
 	return nil
 }
 
 func (s *ServerRPC) VerifyReencrypt(args *VerifyReencryptArgs, _ *VerifyReencryptReply) error {
+	err := s.peer()
+	if err != nil {
+		return err
+	}
 	go s.s.verifyReencrypt(args)
 	return nil
 }
 
 func (s *ServerRPC) ReencryptOK(args *ProofOKArgs, _ *ProofOKReply) error {
-	uid := s.s.partOf[args.Level][args.Gid].Uid
-	member := s.s.members[uid]
+	err := s.peer()
+	if err != nil {
+		return err
+	}
+	member := s.s.member(args.Level, args.Gid)
+	if member == nil {
+		return errors.New("Not a member of the group")
+	}
 	// TODO: actually check if the person sending this is the right server
 	member.queueReencOK(args.Round, args.OK)
 	return nil
 }
 
 func (s *ServerRPC) Finalize(args *FinalizeArgs, _ *FinalizeReply) error {
-	uid := s.s.partOf[args.Level][args.Gid].Uid
-	member := s.s.members[uid]
+	err := s.peer()
+	if err != nil {
+		return err
+	}
+	member := s.s.member(args.Level, args.Gid)
+	if member == nil {
+		return errors.New("Not a member of the group")
+	}
 
 	if s.s.params.Mode == TRAP_MODE {
 		started := member.finalizeStarted(args.Round)
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kwonalbert/atom/common"
 	"github.com/kwonalbert/atom/crypto"
+	"github.com/kwonalbert/atom/directory"
 )
 
 func BenchmarkMixing(b *testing.B) {
@@ -26,3 +29,74 @@ func BenchmarkMixing(b *testing.B) {
 		member.shuffle(ciphertexts)
 	}
 }
+
+func TestMemberCiphertexts(t *testing.T) {
+	keyPair := crypto.GenKey()
+	group := &common.Group{
+		Members:    []int{0},
+		MemberKeys: []*crypto.PublicKey{keyPair.Pub},
+		GroupKey:   keyPair.Pub,
+	}
+	params := common.SystemParameter{Threshold: 1}
+	// more sources than there are groups, and one sends nothing
+	member := NewMember(0, keyPair, params, group, 3)
+	member.startRound(0)
+
+	msgs := crypto.GenRandMsgs(3, 1)
+	ciphertexts := make([]crypto.Ciphertext, len(msgs))
+	for c := range ciphertexts {
+		ciphertexts[c] = crypto.Encrypt(keyPair.Pub, msgs[c])
+	}
+	counts := []int{2, 0, 1}
+	for source, n := range counts {
+		if err := member.expect(0, source, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if member.expect(0, 0, 1) == nil {
+		t.Error("Source counted twice")
+	}
+
+	done := make(chan []crypto.Ciphertext)
+	go func() {
+		done <- member.ciphertexts(0)
+	}()
+	member.collect(0, 0, ciphertexts[:2])
+	member.collect(0, 2, ciphertexts[2:])
+	if got := <-done; len(got) != len(ciphertexts) {
+		t.Error("Wrong number of ciphertexts:", len(got))
+	}
+}
+
+func TestDivide(t *testing.T) {
+	neighbors := []*common.Group{{}, {}, {}}
+	member := Member{group: &common.Group{AdjList: neighbors}}
+	batches := member.divide(make([]crypto.Ciphertext, 7))
+	sizes := []int{3, 2, 2}
+	for b := range batches {
+		if len(batches[b]) != sizes[b] {
+			t.Error("Batch", b, "has", len(batches[b]), "ciphertexts")
+		}
+	}
+}
+
+func TestPeerNewEpoch(t *testing.T) {
+	s := &Server{
+		elock:     new(sync.RWMutex),
+		directory: &directory.Directory{},
+	}
+	s.ecnd = sync.NewCond(s.elock.RLocker())
+	cert := []byte("cert")
+
+	// the caller is in an epoch the server only gets a bit later
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.elock.Lock()
+		s.directory = &directory.Directory{Certificates: [][][]byte{{cert}}}
+		s.elock.Unlock()
+		s.ecnd.Broadcast()
+	}()
+	if err := (&ServerRPC{s, cert}).peer(); err != nil {
+		t.Error("Server of the next epoch refused:", err)
+	}
+}
@@ -0,0 +1,124 @@
+package trustee
+
+import (
+	"fmt"
+
+	"github.com/kwonalbert/atom/directory"
+
+	. "github.com/kwonalbert/atom/atomrpc"
+	. "github.com/kwonalbert/atom/common"
+	. "github.com/kwonalbert/atom/crypto"
+)
+
+// layout is the network of an epoch, as far as the trustees need it to
+// know who may report for which group
+type layout struct {
+	epoch   int
+	groups  map[int]*Group // by uid
+	entries []int          // uids of the first level, whose members report
+	exits   []int          // uids of the last level, which recover traps
+	keys    []*PublicKey   // servers' long-term keys, by id
+}
+
+func newLayout(epoch int, network [][]*Group, keys []*PublicKey) *layout {
+	groups := make(map[int]*Group)
+	for level := range network {
+		for _, group := range network[level] {
+			groups[group.Uid] = group
+		}
+	}
+	var entries, exits []int
+	if len(network) > 0 {
+		for _, group := range network[0] {
+			entries = append(entries, group.Uid)
+		}
+		for _, group := range network[len(network)-1] {
+			exits = append(exits, group.Uid)
+		}
+	}
+	return &layout{
+		epoch:   epoch,
+		groups:  groups,
+		entries: entries,
+		exits:   exits,
+		keys:    keys,
+	}
+}
+
+// member returns the key of server sid if it is in the group uid, and
+// the group is one of uids
+func (l *layout) member(epoch, sid, uid int, uids []int) (*PublicKey, error) {
+	if epoch != l.epoch {
+		return nil, fmt.Errorf("Report for epoch %d in epoch %d", epoch, l.epoch)
+	}
+	group, ok := l.groups[uid]
+	if !ok {
+		return nil, fmt.Errorf("No group %d", uid)
+	}
+	if !IsMember(uid, uids) {
+		return nil, fmt.Errorf("Group %d does not report", uid)
+	}
+	if !IsMember(sid, group.Members) {
+		return nil, fmt.Errorf("Server %d is not in group %d", sid, uid)
+	}
+	return l.keys[sid], nil
+}
+
+// check that report is signed by a member of the entry group it
+// reports for
+func (l *layout) check(report *ReportArgs) error {
+	pub, err := l.member(report.Epoch, report.Sid, report.Uid, l.entries)
+	if err != nil {
+		return err
+	}
+	return report.Verify(pub)
+}
+
+func (l *layout) checkEntry(report *EntryReport) error {
+	pub, err := l.member(report.Epoch, report.Sid, report.Uid, l.entries)
+	if err != nil {
+		return err
+	}
+	return report.Verify(pub)
+}
+
+func (l *layout) checkExit(report *ExitReport) error {
+	pub, err := l.member(report.Epoch, report.Sid, report.Uid, l.exits)
+	if err != nil {
+		return err
+	}
+	if len(report.Rs) != len(l.entries) {
+		return fmt.Errorf("Rs for %d of %d entry groups",
+			len(report.Rs), len(l.entries))
+	}
+	return report.Verify(pub)
+}
+
+// currentLayout returns the layout of the directories' current epoch,
+// generating it again only once the epoch changes
+func (t *Trustee) currentLayout() (*layout, error) {
+	t.llock.Lock()
+	defer t.llock.Unlock()
+	var epoch int
+	err := t.dirServers[0].Call("DirectoryRPC.Epoch", 0, &epoch)
+	if err != nil {
+		return nil, err
+	}
+	if t.layout != nil && t.layout.epoch == epoch {
+		return t.layout, nil
+	}
+
+	dir, params, keys, err := directory.GetDirectory(t.dirServers,
+		t.dirKeys, t.quorum)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := directory.GetRandomness(t.dirServers, t.dirKeys, dir.Epoch)
+	if err != nil {
+		return nil, err
+	}
+	network := GenerateGroups(seed, params.NetType, params.NumServers,
+		params.NumGroups, params.PerGroup, params.NumLevels, keys)
+	t.layout = newLayout(dir.Epoch, network, keys)
+	return t.layout, nil
+}
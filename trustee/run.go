@@ -0,0 +1,119 @@
+package trustee
+
+import (
+	"log"
+	"time"
+
+	. "github.com/kwonalbert/atom/common"
+)
+
+// rounds kept after they open, so late reports and Reports calls can
+// still be answered
+const KEEP_ROUNDS = 2
+
+// how many rounds ahead of this trustee another may start a key
+const ROUND_WINDOW = 2
+
+// how long the trustees have to make the key of a round
+const DKG_TIMEOUT = time.Minute
+
+// Run makes the key of every round until the trustee is closed. With a
+// round schedule, the key of the next round is made while the current
+// one is open; otherwise, once the current one is decided. Rounds that
+// closed while the trustee was down are skipped.
+func (t *Trustee) Run() {
+	for {
+		schedule := t.directory.Schedule
+		t.slock.Lock()
+		if schedule.Period > 0 {
+			next := schedule.Next(t.round-1, time.Now())
+			if next > t.round {
+				log.Println("Skipping to round", next)
+				t.round = next
+			}
+		}
+		round := t.round
+		t.slock.Unlock()
+
+		err := t.RegisterRound()
+		if err != nil {
+			// the round never opens; with a schedule, its slot
+			// still has to pass
+			log.Println("Round", round, "key err:", err)
+			if schedule.Period == 0 {
+				select {
+				case <-time.After(DEFAULT_TIMEOUT):
+					continue
+				case <-t.done:
+					return
+				}
+			}
+		}
+		if !t.waitRound(round) {
+			return
+		}
+		t.forget(round - KEEP_ROUNDS)
+	}
+}
+
+// waitRound waits until round opens, or is decided if there is no
+// schedule; false if the trustee was closed first. A scheduled round
+// is waited for by the clock, so a round that never got its key does
+// not hold up the ones after it.
+func (t *Trustee) waitRound(round int) bool {
+	if t.directory.Schedule.Period > 0 {
+		select {
+		case <-time.After(time.Until(t.directory.Schedule.Open(round))):
+			return true
+		case <-t.done:
+			return false
+		}
+	}
+
+	state, err := t.roundState(round)
+	if err != nil {
+		log.Println("Round", round, "err:", err)
+		return true
+	}
+	decided := make(chan bool)
+	go func() {
+		state.wait()
+		close(decided)
+	}()
+	select {
+	case <-decided:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// forget drops the keys and reports of every round before round. A
+// round still waiting for its verdict is kept, until it is KEEP_ROUNDS
+// older than that or past its deadline; then it is withheld first.
+func (t *Trustee) forget(round int) {
+	t.slock.Lock()
+	defer t.slock.Unlock()
+	now := time.Now()
+	for r, state := range t.rounds {
+		if r < round && !state.decided() &&
+			(r < round-KEEP_ROUNDS || state.overdue(now)) {
+			state.expire()
+		}
+	}
+	for r := range t.shares {
+		state, ok := t.rounds[r]
+		if r < round && (!ok || state.decided()) {
+			delete(t.shares, r)
+			delete(t.rounds, r)
+		}
+	}
+	for r, state := range t.rounds {
+		if r < round && state.decided() {
+			delete(t.rounds, r)
+		}
+	}
+	if round > t.oldest {
+		t.oldest = round
+	}
+}
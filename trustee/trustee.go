@@ -1,6 +1,7 @@
 package trustee
 
 import (
+	"bytes"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -9,6 +10,8 @@ import (
 	"net/rpc"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/kwonalbert/atom/directory"
 
@@ -18,7 +21,8 @@ import (
 )
 
 type TrusteeRPC struct {
-	t *Trustee
+	t    *Trustee
+	cert []byte // the caller's certificate
 }
 
 type Trustee struct {
@@ -26,31 +30,48 @@ type Trustee struct {
 	id   int
 	port int
 
-	round     int
-	roundKeys map[int]*KeyPair
-	roundGood map[int]chan bool
+	round int
+
+	// per round key generation among the trustees, and the reports
+	// of each round
+	slock  *sync.Mutex
+	shares map[int]*Threshold
+	rounds map[int]*roundState
+	ready  chan bool // closed once the other trustees are known
+	oldest int       // rounds before this one are forgotten
+	done   chan bool // closed by Close
+
+	// the groups of the current epoch, to authenticate reports
+	llock  *sync.Mutex
+	layout *layout
 
 	params     SystemParameter
 	NumReports int // number of expected reports
 
+	deadline time.Duration // 0 waits for every report
+	policy   int           // decision once the deadline passes
+
 	keyPair *KeyPair
 
 	dirAddrs   []string
 	dirServers []*rpc.Client
+	dirKeys    []*PublicKey
+	quorum     int // # of directories that must agree
 	directory  *directory.Directory
 	publicKeys []*PublicKey
 
-	reports map[int]chan *ReportArgs
-
 	listener net.Listener
 
 	tlsCert   *tls.Certificate
 	tlsConfig *tls.Config
 
-	Priv *PrivateKey
+	pool *ConnPool // to the other trustees
+
+	audit *auditLog // nil if verdicts are not logged
 }
 
-func NewTrustee(addr string, id int, keyFile string, dirAddrs []string) (*Trustee, error) {
+func NewTrustee(addr string, id int, keyFile string,
+	dirAddrs []string, dirCerts [][]byte) (*Trustee, error) {
 	tlsCert, tlsConfig := AtomTLSConfig()
 
 	port, err := strconv.Atoi(strings.Split(addr, ":")[1])
@@ -68,19 +89,19 @@ func NewTrustee(addr string, id int, keyFile string, dirAddrs []string) (*Truste
 			return nil, err
 		}
 		keyPair = LoadKey(serverKeys[id])
-		if err != nil {
-			return nil, err
-		}
 	}
 
-	l, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), tlsConfig)
+	l, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), PeerConfig(tlsConfig))
 	if err != nil {
 		return nil, err
 	}
 
+	if len(dirCerts) != len(dirAddrs) {
+		return nil, errors.New("Need a certificate for every directory")
+	}
 	dirServers := make([]*rpc.Client, len(dirAddrs))
 	for d, dirAddr := range dirAddrs {
-		conn, err := tls.Dial("tcp", dirAddr, tlsConfig)
+		conn, err := DialPinned(dirAddr, tlsConfig, dirCerts[d])
 		if err != nil {
 			return nil, err
 		}
@@ -92,25 +113,34 @@ func NewTrustee(addr string, id int, keyFile string, dirAddrs []string) (*Truste
 		id:   id,
 		port: port,
 
-		round:     0,
-		roundKeys: make(map[int]*KeyPair),
-		roundGood: make(map[int]chan bool),
+		round: 0,
+
+		slock:  new(sync.Mutex),
+		shares: make(map[int]*Threshold),
+		rounds: make(map[int]*roundState),
+		ready:  make(chan bool),
+		done:   make(chan bool),
+
+		llock: new(sync.Mutex),
 
 		keyPair: keyPair,
 
 		dirAddrs:   dirAddrs,
 		dirServers: dirServers,
+		quorum:     len(dirAddrs),
 
 		listener: l,
 
-		reports: make(map[int]chan *ReportArgs),
-
 		tlsCert:   tlsCert,
 		tlsConfig: tlsConfig,
+
+		pool: NewConnPool(tlsConfig),
 	}
-	rpcServer := rpc.NewServer()
-	rpcServer.Register(&TrusteeRPC{t})
-	go rpcServer.Accept(l)
+	go ServeWithCert(l, func(cert []byte) *rpc.Server {
+		rpcServer := rpc.NewServer()
+		rpcServer.Register(&TrusteeRPC{t, cert})
+		return rpcServer
+	})
 	return t, nil
 }
 
@@ -124,48 +154,44 @@ func (t *Trustee) Setup() {
 		fmt.Println("Getting directory")
 	}
 	t.getDirectory()
+	close(t.ready)
 }
 
-func (t *Trustee) returnResult(round int, res bool) {
-	for i := 0; i < t.NumReports; i++ {
-		t.roundGood[round] <- res
+// SetAuditLog appends every verdict to the file at path from now on
+func (t *Trustee) SetAuditLog(path string) error {
+	audit, err := openAuditLog(path)
+	if err != nil {
+		return err
 	}
+	t.audit = audit
+	return nil
 }
 
-func (t *Trustee) checkReports(round int) {
-	totalTraps := make(map[int]int)
-	totalMsgs := make(map[int]int)
-	for i := 0; i < t.NumReports; i++ {
-		report := <-t.reports[round]
-		if !report.CorrectHash || !report.CorrectTraps || !report.NoDups {
-			t.returnResult(round, false)
-		}
-		if _, ok := totalTraps[report.Uid]; !ok {
-			totalTraps[report.Uid] = report.NumTraps
-			totalMsgs[report.Uid] = report.NumMsgs
-		}
-		if totalTraps[report.Uid] != report.NumTraps ||
-			totalMsgs[report.Uid] != report.NumMsgs {
-			t.returnResult(round, false)
-		}
-	}
+// SetDeadline makes the trustee decide a round deadline after its first
+// report even if reports are missing, WITHHOLD_LATE or RELEASE_QUORUM
+func (t *Trustee) SetDeadline(deadline time.Duration, policy int) {
+	t.deadline = deadline
+	t.policy = policy
+}
 
-	sumTraps := 0
-	sumMsgs := 0
-	for uid := range totalTraps {
-		sumTraps += totalTraps[uid]
-		sumMsgs += totalMsgs[uid]
-	}
-	if sumTraps != sumMsgs {
-		t.returnResult(round, false)
-	}
-	t.returnResult(round, true)
+// Set how many directories have to agree on a snapshot;
+// defaults to all of them
+func (t *Trustee) SetQuorum(quorum int) {
+	t.quorum = quorum
 }
 
 func (t *Trustee) Close() {
+	close(t.done)
 	if t.listener != nil {
 		t.listener.Close()
 	}
+	for _, dirServer := range t.dirServers {
+		dirServer.Close()
+	}
+	t.pool.Close()
+	if t.audit != nil {
+		t.audit.Close()
+	}
 }
 
 func (t *Trustee) registerTrustee() {
@@ -177,6 +203,7 @@ func (t *Trustee) registerTrustee() {
 			Key:         pub,
 			Certificate: t.tlsCert.Certificate,
 		}
+		reg.Sign(t.keyPair.Priv)
 		err := dirServer.Call("DirectoryRPC.RegisterTrustee", reg, nil)
 		if err != nil {
 			log.Fatal("Register err:", err)
@@ -185,67 +212,330 @@ func (t *Trustee) registerTrustee() {
 }
 
 func (t *Trustee) getDirectory() {
-	// TODO:  actually check consensus
-	for _, dirServer := range t.dirServers {
-
-		var direc directory.Directory
-		err := dirServer.Call("DirectoryRPC.Directory", 0, &direc)
-		if err != nil {
-			log.Fatal("Directory err:", err)
-		}
-
-		t.directory = &direc
-		t.params = direc.SystemParameter
-		t.NumReports = t.params.NumGroups * t.params.Threshold
+	t.dirKeys = directory.GetKeys(t.dirServers)
+	var err error
+	t.directory, t.params, _, err = directory.GetDirectory(t.dirServers,
+		t.dirKeys, t.quorum)
+	if err != nil {
+		log.Fatal("Directory err:", err)
 	}
+	t.NumReports = t.params.NumGroups * t.params.Threshold
 
 	publicKeys := make([]*PublicKey, len(t.directory.TrusteeKeys))
 	for i, pub := range t.directory.TrusteeKeys {
 		publicKeys[i] = LoadPubKey(pub)
 	}
 	t.publicKeys = publicKeys
+
+	for i, addr := range t.directory.Trustees {
+		t.pool.Pin(addr, Leaf(t.directory.TrusteeCerts[i]))
+	}
+}
+
+// roundShare returns this trustee's key generation for round. It is
+// made by whichever comes first, RegisterRound or a deal from another
+// trustee.
+func (t *Trustee) roundShare(round int) *Threshold {
+	<-t.ready
+	t.slock.Lock()
+	defer t.slock.Unlock()
+	share, ok := t.shares[round]
+	if !ok {
+		share = NewThreshold(t.id, t.params.TrusteeThreshold,
+			t.keyPair, t.publicKeys)
+		t.shares[round] = share
+	}
+	return share
 }
 
-func (t *Trustee) RegisterRound() {
-	// TODO: actually generate per round keys and share it,
-	// instead of using long-term key every round
-	// currently not using threshold for trustees
+func (t *Trustee) sendResponse(round int, resp *ThresholdResponse) {
+	args := RoundResponseArgs{
+		Round: round,
+		Idx:   t.id,
+		Resp:  resp,
+	}
+	err := args.Sign(t.keyPair.Priv)
+	if err != nil {
+		log.Println("Response err:", err)
+		return
+	}
+	for other, addr := range t.directory.Trustees {
+		if other == t.id {
+			continue
+		}
+		err := t.pool.Call(addr, "TrusteeRPC.Response", &args, nil, DEFAULT_TIMEOUT)
+		if err != nil {
+			log.Println("Response to trustee", other, "failed:", err)
+		}
+	}
+}
+
+// RegisterRound generates a fresh key for the next round together
+// with the other trustees, and registers its public half with the
+// qualified set of trustees that made it. Trustees that have not
+// dealt within DKG_TIMEOUT are left out, and the round gets no key if
+// that leaves fewer than TrusteeThreshold of them.
+func (t *Trustee) RegisterRound() error {
+	t.slock.Lock()
 	round := t.round
-	t.reports[round] = make(chan *ReportArgs, t.NumReports)
-	t.roundKeys[round] = t.keyPair
-	t.roundGood[round] = make(chan bool, t.NumReports)
-	t.Priv = t.keyPair.Priv
+	t.round += 1
+	t.slock.Unlock()
 
-	roundKey := CombinePublicKeys(t.publicKeys)
-	roundPub := DumpPubKey(roundKey)
+	share := t.roundShare(round)
+	for other, addr := range t.directory.Trustees {
+		if other == t.id {
+			continue
+		}
+		args := RoundDealArgs{
+			Round: round,
+			Idx:   t.id,
+			Deal:  share.GetDeal(other),
+		}
+		err := args.Sign(t.keyPair.Priv)
+		if err != nil {
+			return err
+		}
+		err = t.pool.Call(addr, "TrusteeRPC.Deal", &args, nil, DEFAULT_TIMEOUT)
+		if err != nil {
+			log.Println("Deal to trustee", other, "failed:", err)
+		}
+	}
+	err := share.JVSSTimeout(DKG_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	roundPub := DumpPubKey(share.PublicKey())
+	var commits []string
+	for _, c := range share.Commits() {
+		commits = append(commits, DumpPubKey(c))
+	}
+	qual := share.QUAL()
 
 	for _, dirServer := range t.dirServers {
 		reg := &directory.Registration{
-			Round: t.round,
-			Id:    t.id,
-			Key:   roundPub,
+			Round:   round,
+			Id:      t.id,
+			Key:     roundPub,
+			Commits: commits,
+			Qual:    qual,
 		}
+		reg.SignRound(t.keyPair.Priv)
 		err := dirServer.Call("DirectoryRPC.RegisterRound", reg, nil)
 		if err != nil {
-			log.Fatal("Register err:", err)
+			return err
 		}
 	}
 
-	go t.checkReports(round)
+	t.slock.Lock()
+	state := newRoundState(round, t.NumReports, t.seal)
+	state.deadline = t.deadline
+	state.policy = t.policy
+	state.quorum = t.params.Threshold
+	t.rounds[round] = state
+	t.slock.Unlock()
+	return nil
+}
 
-	t.round += 1
+// seal signs and records a verdict before anyone gets to see it
+func (t *Trustee) seal(verdict *Verdict) {
+	verdict.Trustee = t.id
+	verdict.Sign(t.keyPair.Priv)
+	if t.audit != nil {
+		err := t.audit.append(verdict)
+		if err != nil {
+			log.Fatal("Audit log err:", err)
+		}
+	}
+	go t.publishVerdict(verdict)
 }
 
-func (t *TrusteeRPC) Report(report *ReportArgs, reply *ReportReply) error {
-	t.t.reports[report.Round] <- report
-	ok := <-t.t.roundGood[report.Round]
-	if ok {
-		*reply = ReportReply{
-			Priv: t.t.keyPair.Priv,
+func (t *Trustee) publishVerdict(verdict *Verdict) {
+	for d, dirServer := range t.dirServers {
+		err := dirServer.Call("DirectoryRPC.RegisterVerdict", verdict, nil)
+		if err != nil {
+			log.Println("Verdict not registered with directory", d, ":", err)
 		}
+	}
+}
+
+// finishedShare returns this trustee's share of round's key, if the
+// key was made and is not forgotten
+func (t *Trustee) finishedShare(round int) (*Threshold, error) {
+	t.slock.Lock()
+	defer t.slock.Unlock()
+	share, ok := t.shares[round]
+	if !ok || t.rounds[round] == nil {
+		return nil, fmt.Errorf("No key for round %d", round)
+	}
+	return share, nil
+}
+
+func (t *Trustee) roundState(round int) (*roundState, error) {
+	t.slock.Lock()
+	defer t.slock.Unlock()
+	state, ok := t.rounds[round]
+	if !ok {
+		return nil, fmt.Errorf("Round %d is not registered", round)
+	}
+	return state, nil
+}
+
+// check round is neither forgotten, so its key is not made again,
+// nor too far ahead, so no one can make keys for rounds to come
+func (t *Trustee) checkRound(round int) error {
+	t.slock.Lock()
+	defer t.slock.Unlock()
+	if round < t.oldest {
+		return fmt.Errorf("Round %d is forgotten", round)
+	} else if round >= t.round+ROUND_WINDOW {
+		return fmt.Errorf("Round %d is too far ahead", round)
+	}
+	return nil
+}
+
+// check a deal or response comes from trustee idx of round
+func (t *Trustee) checkTrustee(round, idx int, verify func(*PublicKey) error) error {
+	<-t.ready
+	if idx < 0 || idx >= len(t.publicKeys) || idx == t.id {
+		return fmt.Errorf("Invalid trustee %d", idx)
+	}
+	err := verify(t.publicKeys[idx])
+	if err != nil {
+		return err
+	}
+	return t.checkRound(round)
+}
+
+// check the caller is another trustee; servers and clients only
+// report and read reports
+func (t *TrusteeRPC) peer() error {
+	<-t.t.ready
+	for _, chain := range t.t.directory.TrusteeCerts {
+		leaf := Leaf(chain)
+		if leaf != nil && bytes.Equal(leaf, t.cert) {
+			return nil
+		}
+	}
+	return errors.New("Caller is not a trustee")
+}
+
+func (t *TrusteeRPC) Deal(args *RoundDealArgs, _ *DealReply) error {
+	err := t.peer()
+	if err != nil {
+		return err
+	}
+	err = t.t.checkTrustee(args.Round, args.Idx, args.Verify)
+	if err != nil {
+		return err
+	}
+	resp, err := t.t.roundShare(args.Round).AddDeal(args.Deal)
+	if err != nil {
+		return err
+	}
+	go t.t.sendResponse(args.Round, resp)
+	return nil
+}
+
+func (t *TrusteeRPC) Response(args *RoundResponseArgs, _ *ResponseReply) error {
+	err := t.peer()
+	if err != nil {
+		return err
+	}
+	err = t.t.checkTrustee(args.Round, args.Idx, args.Verify)
+	if err != nil {
+		return err
+	}
+	return t.t.roundShare(args.Round).AddResponse(args.Resp)
+}
+
+func (t *TrusteeRPC) Report(report *ReportArgs, reply *ReportReply) error {
+	state, err := t.t.roundState(report.Round)
+	if err != nil {
+		return err
+	}
+	// taken now, since the round may be forgotten once decided
+	share, err := t.t.finishedShare(report.Round)
+	if err != nil {
+		return err
+	}
+	l, err := state.layoutFor(t.t.currentLayout)
+	if err != nil {
+		return err
+	}
+	err = l.check(report)
+	if err != nil {
+		return err
+	}
+	err = state.add(report)
+	if err != nil {
+		return err
+	}
+
+	reply.Verdict = state.wait()
+	if reply.Verdict.Decision != RELEASE {
 		return nil
-	} else {
-		return errors.New("Report failed")
 	}
 
+	// only the group's own messages are opened, and the share never
+	// leaves the trustee
+	if len(report.Rs) != report.NumMsgs {
+		return errors.New("Report does not match its ciphertexts")
+	}
+	err = state.checkRs(report)
+	if err != nil {
+		return err
+	}
+	secret := share.Share()
+	reply.Partials = make([]*Point, len(report.Rs))
+	reply.Proofs = make([]DLEQProof, len(report.Rs))
+	for i, R := range report.Rs {
+		reply.Partials[i], reply.Proofs[i] = ProveDLEQ(secret, R)
+	}
+	return nil
+}
+
+// EntryReport takes an entry group member's commitment to the trap
+// commitments it got
+func (t *TrusteeRPC) EntryReport(report *EntryReport, _ *int) error {
+	state, err := t.t.roundState(report.Round)
+	if err != nil {
+		return err
+	}
+	l, err := state.layoutFor(t.t.currentLayout)
+	if err != nil {
+		return err
+	}
+	err = l.checkEntry(report)
+	if err != nil {
+		return err
+	}
+	return state.addEntry(report)
+}
+
+// ExitReport takes the traps an exit group recovered
+func (t *TrusteeRPC) ExitReport(report *ExitReport, _ *int) error {
+	state, err := t.t.roundState(report.Round)
+	if err != nil {
+		return err
+	}
+	l, err := state.layoutFor(t.t.currentLayout)
+	if err != nil {
+		return err
+	}
+	err = l.checkExit(report)
+	if err != nil {
+		return err
+	}
+	return state.addExit(report)
+}
+
+// Reports returns all reports of a round once it is decided, so that
+// clients can check their traps were counted.
+func (t *TrusteeRPC) Reports(round *int, reports *[]*ReportArgs) error {
+	state, err := t.t.roundState(*round)
+	if err != nil {
+		return err
+	}
+	*reports = state.allReports()
+	return nil
 }
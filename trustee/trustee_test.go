@@ -1,10 +1,13 @@
 package trustee
 
 import (
-	"crypto/tls"
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/rpc"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -23,21 +26,36 @@ var port = 8001
 var testNet = SQUARE
 var testMode = TRAP_MODE
 
-var numServers = 0
+var numServers = perGroup
+var serverKeys []*KeyPair
 var numGroups = 1
 var perGroup = 3
-var numTrustees = 2
+var numTrustees = 3
+var trusteeThreshold = 2
 
 var numMsgs = 4
 var msgSize = 5
 var threshold = perGroup
-var numClients = 0
 
 func setup() (*directory.Directory, []*Trustee, error) {
-	dir, err := directory.NewDirectory(0, dirPort, testMode, testNet,
-		numServers, numGroups, perGroup, numTrustees,
-		numMsgs, msgSize, threshold,
-		numClients)
+	dirCert, _ := AtomTLSConfig()
+	config := &directory.Config{
+		SystemParameter: SystemParameter{
+			Mode:        testMode,
+			NetType:     testNet,
+			NumServers:  numServers,
+			NumGroups:   numGroups,
+			PerGroup:    perGroup,
+			NumTrustees: numTrustees,
+			NumClients:  numGroups,
+			NumMsgs:     numMsgs,
+			MsgSize:     msgSize,
+			Threshold:   threshold,
+
+			TrusteeThreshold: trusteeThreshold,
+		},
+	}
+	dir, err := directory.NewDirectory(0, dirPort, "", config, "", dirCert)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -47,6 +65,30 @@ func setup() (*directory.Directory, []*Trustee, error) {
 	trustees := make([]*Trustee, numTrustees)
 
 	dirAddrs := []string{fmt.Sprintf(addr, dirPort)}
+	dirCerts := [][]byte{dirCert.Certificate[0]}
+
+	// the servers only register, so the trustees know who reports
+	_, tlsConfig := AtomTLSConfig()
+	conn, err := DialPinned(dirAddrs[0], tlsConfig, dirCerts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	dirServer := rpc.NewClient(conn)
+	defer dirServer.Close()
+	serverKeys = make([]*KeyPair, numServers)
+	for i := range serverKeys {
+		serverKeys[i] = GenKey()
+		reg := &directory.Registration{
+			Addr: fmt.Sprintf(addr, port+numTrustees+i),
+			Id:   i,
+			Key:  DumpPubKey(serverKeys[i].Pub),
+		}
+		reg.Sign(serverKeys[i].Priv)
+		err := dirServer.Call("DirectoryRPC.Register", reg, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
 	wg := new(sync.WaitGroup)
 	for i := range trustees {
@@ -55,7 +97,7 @@ func setup() (*directory.Directory, []*Trustee, error) {
 			defer wg.Done()
 			var err error
 			trustees[i], err = NewTrustee(fmt.Sprintf(addr, port+i), i,
-				"", dirAddrs)
+				"", dirAddrs, dirCerts)
 			if err != nil {
 				log.Fatal("Trustee creation err:", err)
 			}
@@ -65,7 +107,10 @@ func setup() (*directory.Directory, []*Trustee, error) {
 			if i == 0 {
 				fmt.Println("Generating per round keys")
 			}
-			trustees[i].RegisterRound()
+			err = trustees[i].RegisterRound()
+			if err != nil {
+				log.Fatal("Round key err:", err)
+			}
 
 			if i == 0 {
 				fmt.Println("Finished trustee setup")
@@ -76,29 +121,109 @@ func setup() (*directory.Directory, []*Trustee, error) {
 	return dir, trustees, nil
 }
 
+// a correct report of the one inner ciphertext for group uid, signed
+// by server sid
+func signedReport(epoch, sid, uid int, R *Point, key *KeyPair) *ReportArgs {
+	report := &ReportArgs{
+		Round:        0,
+		Epoch:        epoch,
+		Sid:          sid,
+		Uid:          uid,
+		CorrectHash:  true,
+		CorrectTraps: true,
+		NoDups:       true,
+		NumTraps:     1,
+		NumMsgs:      1,
+		Rs:           []*Point{R},
+	}
+	report.Sign(key.Priv)
+	return report
+}
+
+// call method on trustee u over a fresh connection
+func callTrustee(trustees []*Trustee, u int, method string, args, reply interface{}) error {
+	_, tlsConfig := AtomTLSConfig()
+	conn, err := DialPinned(fmt.Sprintf(addr, port+u), tlsConfig,
+		trustees[u].tlsCert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	trustee := rpc.NewClient(conn)
+	defer trustee.Close()
+	return trustee.Call(method, args, reply)
+}
+
 func TestReport(t *testing.T) {
 	_, trustees, err := setup()
 	if err != nil {
 		t.Error(err)
 	}
 
-	// correct report
-	report := ReportArgs{
-		Round:        0,
-		Sid:          0,
-		Uid:          0,
-		CorrectHash:  true,
-		CorrectTraps: true,
-		NumTraps:     128,
-		NumMsgs:      128,
+	roundKey := trustees[0].roundShare(0).PublicKey()
+	commits := trustees[0].roundShare(0).Commits()
+	plaintext := []byte("report")
+	nonce := []byte{0, 0, 0, 0}
+	inner := CCA2Encrypt(plaintext, nonce, roundKey)
+
+	l, err := trustees[0].currentLayout()
+	if err != nil {
+		t.Fatal(err)
 	}
+	uid := l.entries[0]
 
-	_, tlsConfig := AtomTLSConfig()
+	var reply ReportReply
+	err = callTrustee(trustees, 0, "TrusteeRPC.Report",
+		signedReport(l.epoch, 0, uid, inner.R, GenKey()), &reply)
+	if err == nil {
+		t.Error("Accepted a report not signed by the server")
+	}
+	forged := signedReport(l.epoch, 0, uid, inner.R, serverKeys[0])
+	forged.Uid = -1
+	forged.Sign(serverKeys[0].Priv)
+	err = callTrustee(trustees, 0, "TrusteeRPC.Report", forged, &reply)
+	if err == nil {
+		t.Error("Accepted a report for a group the server is not in")
+	}
 
-	replies := make([]*PrivateKey, numGroups*perGroup)
-	repliesLock := make([]*sync.Mutex, numGroups*perGroup)
+	// the entry group commits to the one trap, and the exit group
+	// recovers it
+	trap := Trap{Gid: l.groups[uid].Gid, Nonce: []byte("trap")}
+	exit := l.groups[l.exits[0]]
+	for u := range trustees {
+		for i := 0; i < perGroup; i++ {
+			entry := &EntryReport{
+				Epoch: l.epoch,
+				Sid:   i,
+				Uid:   uid,
+				Traps: CommitSet([]Commitment{Commit(trap)}),
+
+				NumTraps: 1,
+				NumMsgs:  2,
+			}
+			entry.Sign(serverKeys[i].Priv)
+			if err := callTrustee(trustees, u, "TrusteeRPC.EntryReport", entry, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sid := exit.Members[0]
+		recovered := &ExitReport{
+			Epoch: l.epoch,
+			Sid:   sid,
+			Uid:   exit.Uid,
+			Traps: []Trap{trap},
+
+			Rs: [][]*Point{{inner.R}},
+		}
+		recovered.Sign(serverKeys[sid].Priv)
+		if err := callTrustee(trustees, u, "TrusteeRPC.ExitReport", recovered, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each member's partial decryption from each trustee
+	replies := make([][]*Point, numGroups*perGroup)
 	for r := range replies {
-		repliesLock[r] = new(sync.Mutex)
+		replies[r] = make([]*Point, numTrustees)
 	}
 
 	wg := new(sync.WaitGroup)
@@ -107,37 +232,385 @@ func TestReport(t *testing.T) {
 			wg.Add(1)
 			go func(i, u int) {
 				defer wg.Done()
-				conn, err := tls.Dial("tcp", fmt.Sprintf(addr, port+u), tlsConfig)
-				if err != nil {
-					t.Error(err)
-				}
-				trustee := rpc.NewClient(conn)
 				var reply ReportReply
-				err = trustee.Call("TrusteeRPC.Report", &report, &reply)
+				err := callTrustee(trustees, u, "TrusteeRPC.Report",
+					signedReport(l.epoch, i, uid, inner.R, serverKeys[i]), &reply)
 				if err != nil {
 					t.Error(err)
+					return
+				}
+				if reply.Verdict.Decision != RELEASE ||
+					reply.Verdict.Verify(trustees[u].keyPair.Pub) != nil {
+					t.Error("Round not released with a signed verdict")
 				}
-				repliesLock[i].Lock()
-				if replies[i] == nil {
-					replies[i] = reply.Priv
-				} else {
-					tmp := []*PrivateKey{replies[i], reply.Priv}
-					replies[i] = CombinePrivateKeys(tmp)
+				err = VerifyDLEQ(PublicShare(commits, u), inner.R,
+					reply.Partials[0], reply.Proofs[0])
+				if err != nil {
+					t.Error("Bad partial decryption:", err)
 				}
-				repliesLock[i].Unlock()
-				trustee.Close()
+				replies[i][u] = reply.Partials[0]
 			}(i, u)
 		}
 		wg.Wait()
 	}
 
+	// any trusteeThreshold of the partials open the message
 	for r := range replies {
 		for u := range trustees {
-			exp := CombinePublicKeys(trustees[u].publicKeys)
-			res := PubFromPriv(replies[r])
-			if !res.Equal(exp) {
-				t.Error("Failed to recover trustee keys")
+			group := []int{u, (u + 1) % numTrustees}
+			partials := []*Point{replies[r][group[0]], replies[r][group[1]]}
+			shared := CombinePartials(group, partials)
+			res, err := CCA2DecryptShared(inner, nonce, shared, roundKey)
+			if err != nil || !bytes.Equal(res, plaintext) {
+				t.Error("Failed to open the message")
+			}
+		}
+	}
+
+	longTerm := CombinePublicKeys(trustees[0].publicKeys)
+	if trustees[0].roundShare(0).PublicKey().Equal(longTerm) {
+		t.Error("Round key is the long-term key")
+	}
+}
+
+func TestVerdict(t *testing.T) {
+	key := GenKey()
+	state := newRoundState(0, 3, func(v *Verdict) { v.Sign(key.Priv) })
+
+	good := &ReportArgs{CorrectHash: true, CorrectTraps: true, NoDups: true}
+	bad := &ReportArgs{Sid: 1, CorrectHash: true, NoDups: true}
+	for _, report := range []*ReportArgs{good, bad} {
+		if err := state.add(report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := state.add(good); err == nil {
+		t.Error("Accepted a second report from a server")
+	}
+	other := *good
+	other.Sid = 2
+	if err := state.add(&other); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.add(good); err == nil {
+		t.Error("Accepted a report after the verdict")
+	}
+
+	verdict := state.wait()
+	if verdict.Decision != WITHHOLD || verdict.Reason != "server 1: missing traps" {
+		t.Error("Wrong verdict:", verdict.Decision, verdict.Reason)
+	}
+	if err := verdict.Verify(key.Pub); err != nil {
+		t.Error(err)
+	}
+	if state.wait() != verdict {
+		t.Error("Round decided twice")
+	}
+	if len(verdict.Groups) != 1 || len(verdict.Groups[0].Sids) != 3 {
+		t.Error("Wrong group summary:", verdict.Groups)
+	}
+
+	// the audit log gives back verdicts that still verify
+	tmp, err := ioutil.TempDir("", "atom-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	fn := filepath.Join(tmp, "audit.log")
+	audit, err := openAuditLog(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.append(verdict)
+	audit.append(verdict)
+	audit.Close()
+	logged, err := ReadAuditLog(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logged) != 2 {
+		t.Fatal("Wrong number of logged verdicts:", len(logged))
+	}
+	if err := logged[1].Verify(key.Pub); err != nil || logged[1].Reason != verdict.Reason {
+		t.Error("Logged verdict does not verify:", err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	network := [][]*Group{{
+		&Group{Uid: 0, Gid: 0, Members: []int{0, 1}},
+		&Group{Uid: 1, Gid: 1, Members: []int{2, 3}},
+	}}
+	tests := []struct {
+		policy   int
+		reports  [][2]int // sid, uid
+		decision int
+		missing  []int // uids missing reports
+	}{
+		{WITHHOLD_LATE, [][2]int{{0, 0}, {2, 1}}, WITHHOLD, []int{0, 1}},
+		// every group is at quorum
+		{RELEASE_QUORUM, [][2]int{{0, 0}, {2, 1}}, RELEASE, []int{0, 1}},
+		// group 1 is short of quorum
+		{RELEASE_QUORUM, [][2]int{{0, 0}, {1, 0}}, WITHHOLD, []int{1}},
+	}
+
+	for i, test := range tests {
+		state := newRoundState(0, 4, func(v *Verdict) {})
+		state.layout = newLayout(0, network, nil)
+		state.deadline = 50 * time.Millisecond
+		state.policy = test.policy
+		state.quorum = 1
+		// no traps, which every group agrees on
+		for uid := range network[0] {
+			state.entryReports[uid] = map[int]*EntryReport{
+				2 * uid: &EntryReport{Traps: CommitSet(nil)},
+			}
+			state.exitReports[uid] = map[int]*ExitReport{2 * uid: &ExitReport{}}
+		}
+		for _, r := range test.reports {
+			report := &ReportArgs{Sid: r[0], Uid: r[1], CorrectHash: true,
+				CorrectTraps: true, NoDups: true}
+			if err := state.add(report); err != nil {
+				t.Fatal(err)
 			}
 		}
+
+		verdict := state.wait()
+		if verdict.Decision != test.decision {
+			t.Error(i, "wrong verdict at the deadline:", verdict.Reason)
+		}
+		if len(verdict.Missing) != len(test.missing) {
+			t.Error(i, "wrong reports missing:", verdict.Missing)
+			continue
+		}
+		for m, uid := range test.missing {
+			if verdict.Missing[m].Uid != uid {
+				t.Error(i, "wrong reports missing:", verdict.Missing)
+			}
+		}
+	}
+}
+
+func TestForget(t *testing.T) {
+	tr := &Trustee{
+		slock:  new(sync.Mutex),
+		shares: make(map[int]*Threshold),
+		rounds: make(map[int]*roundState),
+	}
+	for r := 0; r < 4; r++ {
+		tr.shares[r] = nil
+		tr.rounds[r] = newRoundState(r, 1, nil)
+		// round 0 is still waiting for its reports
+		if r > 0 {
+			tr.rounds[r].verdict = &Verdict{Round: r}
+		}
+	}
+	tr.forget(2)
+	if len(tr.shares) != 3 || len(tr.rounds) != 3 || tr.rounds[2] == nil {
+		t.Error("Wrong rounds forgotten")
+	}
+	if _, err := tr.roundState(1); err == nil {
+		t.Error("Forgotten round still there")
+	}
+	if _, err := tr.finishedShare(1); err == nil {
+		t.Error("Forgotten key still there")
+	}
+	if _, err := tr.finishedShare(0); err != nil {
+		t.Error("Undecided round forgotten:", err)
+	}
+	tr.round = 4
+	if tr.checkRound(1) == nil || tr.checkRound(2) != nil {
+		t.Error("Wrong rounds refused")
+	}
+	if tr.checkRound(4+ROUND_WINDOW-1) != nil || tr.checkRound(4+ROUND_WINDOW) == nil {
+		t.Error("Wrong rounds ahead refused")
+	}
+
+	// undecided rounds are not kept forever
+	var sealed *Verdict
+	tr.rounds[0].seal = func(v *Verdict) { sealed = v }
+	tr.forget(2 + KEEP_ROUNDS)
+	if _, err := tr.roundState(0); err == nil {
+		t.Error("Old undecided round still there")
+	}
+	if sealed == nil || sealed.Decision != WITHHOLD {
+		t.Error("Old undecided round not withheld:", sealed)
+	}
+}
+
+func TestWaitScheduledRound(t *testing.T) {
+	period := 50 * time.Millisecond
+	tr := &Trustee{
+		slock:     new(sync.Mutex),
+		rounds:    make(map[int]*roundState),
+		done:      make(chan bool),
+		directory: &directory.Directory{},
+	}
+	tr.directory.Schedule = directory.Schedule{
+		Start:  time.Now(),
+		Period: period,
+		Window: period,
+	}
+	// round 2 never got a key, but its slot still passes
+	start := time.Now()
+	if !tr.waitRound(2) {
+		t.Fatal("Trustee closed")
+	}
+	if time.Since(start) < period {
+		t.Error("Round waited for before it opened")
+	}
+	close(tr.done)
+	if tr.waitRound(10) {
+		t.Error("Waited for a round after the trustee closed")
+	}
+}
+
+func TestSignedDeal(t *testing.T) {
+	keys := []*KeyPair{GenKey(), GenKey()}
+	pubs := []*PublicKey{keys[0].Pub, keys[1].Pub}
+	tr := &Trustee{
+		id:         0,
+		slock:      new(sync.Mutex),
+		ready:      make(chan bool),
+		publicKeys: pubs,
+	}
+	close(tr.ready)
+
+	share := NewThreshold(1, 2, keys[1], pubs)
+	args := &RoundDealArgs{Round: 0, Idx: 1, Deal: share.GetDeal(0)}
+	if err := tr.checkTrustee(args.Round, args.Idx, args.Verify); err == nil {
+		t.Error("Accepted an unsigned deal")
+	}
+	args.Sign(keys[0].Priv)
+	if err := tr.checkTrustee(args.Round, args.Idx, args.Verify); err == nil {
+		t.Error("Accepted a deal signed by another trustee")
+	}
+	args.Sign(keys[1].Priv)
+	if err := tr.checkTrustee(args.Round, args.Idx, args.Verify); err != nil {
+		t.Error(err)
+	}
+	args.Round = 1
+	if err := tr.checkTrustee(args.Round, args.Idx, args.Verify); err == nil {
+		t.Error("Accepted a deal for another round")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	network := [][]*Group{
+		{&Group{Uid: 0, Gid: 0, Members: []int{0}},
+			&Group{Uid: 1, Gid: 1, Members: []int{1}}},
+		{&Group{Uid: 2, Gid: 0, Members: []int{2}},
+			&Group{Uid: 3, Gid: 1, Members: []int{3}}},
+	}
+	traps := []Trap{
+		{Gid: 0, Nonce: []byte("a")},
+		{Gid: 1, Nonce: []byte("b")},
+		{Gid: 1, Nonce: []byte("c")},
+	}
+	substituted := []Trap{traps[0], {Gid: 1, Nonce: []byte("x")}, traps[2]}
+	shuffled := []Trap{traps[2], traps[0], traps[1]}
+
+	// group 0 lets in traps[:1] with one message, group 1 traps[1:]
+	// with numMsgs-2 of them; the exit groups split the recovered traps
+	// between them, and send sent[gid] messages to each entry group,
+	// whose members say they got got[gid]
+	tests := []struct {
+		recovered []Trap // nil if the exit groups publish nothing
+		numMsgs   int
+		sent      []int
+		got       []int
+		decision  int
+		uids      []int // groups found at fault
+	}{
+		{shuffled, 4, []int{1, 2}, []int{1, 2}, RELEASE, nil},
+		// a message in place of a trap
+		{substituted, 4, []int{1, 2}, []int{1, 2}, WITHHOLD, []int{1}},
+		// a group that let in fewer real messages than traps
+		{shuffled, 3, []int{1, 2}, []int{1, 2}, WITHHOLD, []int{1}},
+		// without the exit groups, every group is at fault
+		{nil, 4, []int{0, 0}, []int{0, 0}, WITHHOLD, []int{2, 3, 0, 1}},
+		// group 1 got fewer messages than were sent to it
+		{shuffled, 4, []int{1, 2}, []int{1, 1}, WITHHOLD, []int{1}},
+		// a message lost while mixing, which no group is at fault for
+		{shuffled, 4, []int{1, 1}, []int{1, 1}, WITHHOLD, nil},
+	}
+
+	for i, test := range tests {
+		state := newRoundState(0, 2, nil)
+		state.layout = newLayout(0, network, nil)
+		for uid, entered := range [][]Trap{traps[:1], traps[1:]} {
+			numMsgs := 2
+			if uid == 1 {
+				numMsgs = test.numMsgs
+			}
+			report := &EntryReport{
+				Traps:    CommitSet(commitTraps(entered)),
+				NumTraps: len(entered),
+				NumMsgs:  numMsgs,
+			}
+			state.entryReports[uid] = map[int]*EntryReport{uid: report}
+			state.reports = append(state.reports,
+				&ReportArgs{Sid: uid, Uid: uid, NumMsgs: test.got[uid]})
+		}
+		if test.recovered != nil {
+			Rs := make([][]*Point, len(test.sent))
+			for gid, n := range test.sent {
+				for m := 0; m < n; m++ {
+					Rs[gid] = append(Rs[gid], (*Point)(GenKey().Pub))
+				}
+			}
+			state.exitReports[2] = map[int]*ExitReport{
+				2: &ExitReport{Traps: test.recovered[:2], Rs: Rs},
+			}
+			state.exitReports[3] = map[int]*ExitReport{
+				3: &ExitReport{Traps: test.recovered[2:], Rs: make([][]*Point, 2)},
+			}
+		}
+
+		decision, reason, findings := state.audit()
+		if decision != test.decision {
+			t.Error(i, "wrong decision:", reason, findings)
+		}
+		if len(findings) != len(test.uids) {
+			t.Error(i, "wrong findings:", findings)
+			continue
+		}
+		for f, uid := range test.uids {
+			if findings[f].Uid != uid {
+				t.Error(i, "wrong findings:", findings)
+			}
+		}
+	}
+}
+
+func TestCheckRs(t *testing.T) {
+	network := [][]*Group{
+		{&Group{Uid: 0, Gid: 0, Members: []int{0}},
+			&Group{Uid: 1, Gid: 1, Members: []int{1}}},
+		{&Group{Uid: 2, Gid: 0, Members: []int{2}},
+			&Group{Uid: 3, Gid: 1, Members: []int{3}}},
+	}
+	Rs := []*Point{(*Point)(GenKey().Pub), (*Point)(GenKey().Pub), (*Point)(GenKey().Pub)}
+	state := newRoundState(0, 2, nil)
+	state.layout = newLayout(0, network, nil)
+	// both exit groups send to group 0, and only the second to group 1
+	state.exitReports[2] = map[int]*ExitReport{
+		2: &ExitReport{Rs: [][]*Point{{Rs[0]}, nil}},
+	}
+	state.exitReports[3] = map[int]*ExitReport{
+		3: &ExitReport{Rs: [][]*Point{{Rs[1]}, {Rs[2]}}},
+	}
+
+	if err := state.checkRs(&ReportArgs{Uid: 0, Rs: []*Point{Rs[1], Rs[0]}}); err != nil {
+		t.Error(err)
+	}
+	if state.checkRs(&ReportArgs{Uid: 0, Rs: []*Point{Rs[0], Rs[2]}}) == nil {
+		t.Error("Decrypting a ciphertext sent to another group")
+	}
+	if state.checkRs(&ReportArgs{Uid: 1, Rs: nil}) == nil {
+		t.Error("Decrypting without the group's ciphertexts")
+	}
+	if state.checkRs(&ReportArgs{Uid: 1, Rs: []*Point{Rs[2], Rs[2]}}) == nil {
+		t.Error("Decrypting a ciphertext twice")
 	}
 }
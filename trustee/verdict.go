@@ -0,0 +1,529 @@
+package trustee
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/kwonalbert/atom/atomrpc"
+	. "github.com/kwonalbert/atom/common"
+	. "github.com/kwonalbert/atom/crypto"
+)
+
+// roundState collects the reports of a round until every expected one
+// is in, and then decides the round exactly once
+type roundState struct {
+	round    int
+	cond     *sync.Cond
+	expected int
+	reports  []*ReportArgs
+	reported map[[2]int]bool // (sid, uid) pairs that reported
+	verdict  *Verdict        // nil until decided
+
+	layout *layout // the epoch the round's reports come from
+
+	// the trap audit: what each entry group member committed to, and
+	// what each exit group recovered, by uid and then sid
+	entryReports map[int]map[int]*EntryReport
+	exitReports  map[int]map[int]*ExitReport
+
+	// how long after the first report the round is decided anyway,
+	// how, and how many reports each group needs for RELEASE_QUORUM
+	deadline time.Duration
+	policy   int
+	quorum   int
+
+	made time.Time // when the round's key was made
+
+	seal func(*Verdict) // signs the verdict once it is decided
+}
+
+// what a trustee decides when reports are still missing at the deadline
+const (
+	WITHHOLD_LATE  = 0 // withhold the round
+	RELEASE_QUORUM = 1 // judge the reports in, if every group has quorum
+)
+
+func newRoundState(round, expected int, seal func(*Verdict)) *roundState {
+	return &roundState{
+		round:    round,
+		cond:     sync.NewCond(new(sync.Mutex)),
+		expected: expected,
+		reported: make(map[[2]int]bool),
+
+		entryReports: make(map[int]map[int]*EntryReport),
+		exitReports:  make(map[int]map[int]*ExitReport),
+
+		made: time.Now(),
+		seal: seal,
+	}
+}
+
+// add records report, deciding the round if it was the last one
+// expected
+func (r *roundState) add(report *ReportArgs) error {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	if r.verdict != nil {
+		return fmt.Errorf("Round %d is already decided", r.round)
+	}
+	key := [2]int{report.Sid, report.Uid}
+	if r.reported[key] {
+		return fmt.Errorf("Server %d already reported for group %d",
+			report.Sid, report.Uid)
+	}
+	r.reported[key] = true
+	r.reports = append(r.reports, report)
+	if len(r.reports) == 1 && r.deadline > 0 {
+		time.AfterFunc(r.deadline, r.expire)
+	}
+	if len(r.reports) == r.expected {
+		decision, reason, findings := r.evaluate()
+		r.decide(decision, reason, nil, findings)
+	}
+	return nil
+}
+
+// addEntry records an entry group member's commitment to its traps
+func (r *roundState) addEntry(report *EntryReport) error {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	if r.verdict != nil {
+		return fmt.Errorf("Round %d is already decided", r.round)
+	}
+	if _, ok := r.entryReports[report.Uid][report.Sid]; ok {
+		return fmt.Errorf("Server %d already committed to traps for group %d",
+			report.Sid, report.Uid)
+	}
+	if r.entryReports[report.Uid] == nil {
+		r.entryReports[report.Uid] = make(map[int]*EntryReport)
+	}
+	r.entryReports[report.Uid][report.Sid] = report
+	return nil
+}
+
+// addExit records the traps an exit group recovered
+func (r *roundState) addExit(report *ExitReport) error {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	if r.verdict != nil {
+		return fmt.Errorf("Round %d is already decided", r.round)
+	}
+	if _, ok := r.exitReports[report.Uid][report.Sid]; ok {
+		return fmt.Errorf("Server %d already published traps for group %d",
+			report.Sid, report.Uid)
+	}
+	if r.exitReports[report.Uid] == nil {
+		r.exitReports[report.Uid] = make(map[int]*ExitReport)
+	}
+	r.exitReports[report.Uid][report.Sid] = report
+	return nil
+}
+
+// layoutFor returns the layout the round's reports are checked
+// against, fixed by current on the first report
+func (r *roundState) layoutFor(current func() (*layout, error)) (*layout, error) {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	if r.layout == nil {
+		l, err := current()
+		if err != nil {
+			return nil, err
+		}
+		r.layout = l
+	}
+	return r.layout, nil
+}
+
+// decide seals the verdict and wakes up the waiting reports; the caller
+// holds the lock
+func (r *roundState) decide(decision int, reason string,
+	missing []MissingReports, findings []Finding) {
+	verdict := &Verdict{
+		Round:    r.round,
+		Decision: decision,
+		Reason:   reason,
+		Groups:   summarize(r.reports),
+		Missing:  missing,
+		Findings: findings,
+	}
+	r.seal(verdict)
+	r.verdict = verdict
+	r.cond.Broadcast()
+}
+
+// expire decides the round from the reports in by the deadline
+func (r *roundState) expire() {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	if r.verdict != nil {
+		return
+	}
+	missing, quorate := r.missing()
+	if r.policy == RELEASE_QUORUM && quorate {
+		decision, reason, findings := r.evaluate()
+		r.decide(decision, reason, missing, findings)
+		return
+	}
+	r.decide(WITHHOLD, fmt.Sprintf("%d of %d reports missing",
+		r.expected-len(r.reports), r.expected), missing, nil)
+}
+
+// missing lists the members of every reporting group that have not
+// reported, and whether each group still has quorum reports
+func (r *roundState) missing() ([]MissingReports, bool) {
+	if r.layout == nil {
+		return nil, false
+	}
+	var missing []MissingReports
+	quorate := true
+	for _, uid := range r.layout.entries {
+		members := r.layout.groups[uid].Members
+		var sids []int
+		for _, sid := range members {
+			if !r.reported[[2]int{sid, uid}] {
+				sids = append(sids, sid)
+			}
+		}
+		if len(members)-len(sids) < r.quorum {
+			quorate = false
+		}
+		if len(sids) > 0 {
+			missing = append(missing, MissingReports{Uid: uid, Sids: sids})
+		}
+	}
+	return missing, quorate
+}
+
+// overdue tells whether the deadline has passed since the key was
+// made, so the round is not kept waiting for a first report forever
+func (r *roundState) overdue(now time.Time) bool {
+	return r.deadline > 0 && now.Sub(r.made) > r.deadline
+}
+
+func (r *roundState) decided() bool {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	return r.verdict != nil
+}
+
+// wait blocks until the round is decided, and returns the verdict
+func (r *roundState) wait() *Verdict {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	for r.verdict == nil {
+		r.cond.Wait()
+	}
+	return r.verdict
+}
+
+// all reports, once the round is decided
+func (r *roundState) allReports() []*ReportArgs {
+	r.wait()
+	return r.reports
+}
+
+// what each group reported, in the order of the uids; a group whose
+// members disagree is summarized by its first report
+func summarize(reports []*ReportArgs) []GroupReport {
+	byUid := make(map[int]*GroupReport)
+	var uids []int
+	for _, report := range reports {
+		g, ok := byUid[report.Uid]
+		if !ok {
+			g = &GroupReport{
+				Uid:      report.Uid,
+				NumTraps: report.NumTraps,
+				NumMsgs:  report.NumMsgs,
+			}
+			byUid[report.Uid] = g
+			uids = append(uids, report.Uid)
+		}
+		g.Sids = append(g.Sids, report.Sid)
+	}
+	sort.Ints(uids)
+	groups := make([]GroupReport, len(uids))
+	for i, uid := range uids {
+		groups[i] = *byUid[uid]
+	}
+	return groups
+}
+
+// evaluate judges the reports, and then audits the traps; the caller
+// holds the lock
+func (r *roundState) evaluate() (int, string, []Finding) {
+	decision, reason := judge(r.reports)
+	if decision != RELEASE {
+		return decision, reason, nil
+	}
+	return r.audit()
+}
+
+// audit checks, for every entry group, that the exit groups recovered
+// exactly the traps it committed to, that it let in one real message
+// per trap, and that its members got every real message the exit
+// groups sent it. It does not depend on the counts and flags in the
+// servers' reports, except for what the members say they got, and
+// finds every group that fails.
+func (r *roundState) audit() (int, string, []Finding) {
+	if r.layout == nil {
+		return WITHHOLD, "no layout to audit the traps against", nil
+	}
+	var findings []Finding
+	find := func(group *Group, format string, args ...interface{}) {
+		findings = append(findings, Finding{
+			Uid:    group.Uid,
+			Gid:    group.Gid,
+			Reason: fmt.Sprintf(format, args...),
+		})
+	}
+
+	// commitments of the recovered traps, and the number of real
+	// messages sent, by the entry gid they go to
+	comms := make(map[int][]Commitment)
+	sent := make(map[int]int)
+	for _, uid := range r.layout.exits {
+		group := r.layout.groups[uid]
+		var exit *ExitReport
+		var set Commitment
+		for _, report := range r.exitReports[uid] {
+			reportSet := CommitSet(commitTraps(report.Traps))
+			if exit == nil {
+				exit, set = report, reportSet
+			} else if reportSet != set || !equalRs(report.Rs, exit.Rs) {
+				find(group, "members disagree on the traps")
+				break
+			}
+		}
+		if exit == nil {
+			find(group, "no traps published")
+			continue
+		}
+		for _, trap := range exit.Traps {
+			comms[trap.Gid] = append(comms[trap.Gid], Commit(trap))
+		}
+		for gid, Rs := range exit.Rs {
+			sent[gid] += len(Rs)
+		}
+	}
+
+	// what the members of each entry group say they got; judge checks
+	// they agree
+	got := make(map[int]int)
+	for _, report := range r.reports {
+		got[report.Uid] = report.NumMsgs
+	}
+
+	entered, recovered := 0, 0
+	for _, uid := range r.layout.entries {
+		group := r.layout.groups[uid]
+		var entry *EntryReport
+		for _, report := range r.entryReports[uid] {
+			if entry == nil {
+				entry = report
+			} else if report.Traps != entry.Traps ||
+				report.NumTraps != entry.NumTraps || report.NumMsgs != entry.NumMsgs {
+				find(group, "members disagree on the traps")
+				break
+			}
+		}
+		traps := comms[group.Gid]
+		delete(comms, group.Gid)
+		recovered += sent[group.Gid]
+		if n, ok := got[uid]; ok && n != sent[group.Gid] {
+			find(group, "%d messages sent to the group, %d got", sent[group.Gid], n)
+		}
+		if entry == nil {
+			find(group, "no trap commitments published")
+			continue
+		}
+		entered += entry.NumMsgs - entry.NumTraps
+		if entry.NumMsgs != 2*entry.NumTraps {
+			find(group, "%d ciphertexts for %d traps", entry.NumMsgs, entry.NumTraps)
+		}
+		if len(traps) != entry.NumTraps {
+			find(group, "%d of %d traps recovered", len(traps), entry.NumTraps)
+		} else if CommitSet(traps) != entry.Traps {
+			find(group, "recovered traps do not match the commitments")
+		}
+	}
+
+	// traps naming no entry group
+	var gids []int
+	for gid := range comms {
+		gids = append(gids, gid)
+	}
+	sort.Ints(gids)
+	for _, gid := range gids {
+		findings = append(findings, Finding{
+			Uid:    -1,
+			Gid:    gid,
+			Reason: fmt.Sprintf("%d traps recovered for no group", len(comms[gid])),
+		})
+	}
+
+	if len(findings) > 0 {
+		return WITHHOLD, fmt.Sprintf("trap audit failed for %d groups", len(findings)), findings
+	}
+	// every group's traps made it through, but real messages were
+	// lost or added while mixing; the messages are routed by hash, so
+	// this can't be pinned on an entry group
+	if recovered != entered {
+		return WITHHOLD, fmt.Sprintf("%d messages recovered of %d sent", recovered, entered), nil
+	}
+	return RELEASE, "", nil
+}
+
+// checkRs checks that report asks to decrypt exactly the inner
+// ciphertexts the exit groups sent to its group, in any order; the
+// caller has seen the round released, so the exit groups agree
+func (r *roundState) checkRs(report *ReportArgs) error {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	gid := r.layout.groups[report.Uid].Gid
+	sent := make(map[string]int)
+	for _, uid := range r.layout.exits {
+		for _, exit := range r.exitReports[uid] {
+			for _, R := range exit.Rs[gid] {
+				sent[pointKey(R)]++
+			}
+			break // its members agree
+		}
+	}
+	for _, R := range report.Rs {
+		key := pointKey(R)
+		if sent[key] == 0 {
+			return fmt.Errorf("Server %d asks to decrypt a ciphertext no exit group sent",
+				report.Sid)
+		}
+		sent[key]--
+	}
+	for _, n := range sent {
+		if n != 0 {
+			return fmt.Errorf("Server %d leaves out ciphertexts sent to its group",
+				report.Sid)
+		}
+	}
+	return nil
+}
+
+func pointKey(R *Point) string {
+	b, _ := R.MarshalBinary()
+	return string(b)
+}
+
+func equalRs(a, b [][]*Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for gid := range a {
+		if len(a[gid]) != len(b[gid]) {
+			return false
+		}
+		for i := range a[gid] {
+			if !a[gid][i].Equal(b[gid][i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func commitTraps(traps []Trap) []Commitment {
+	comms := make([]Commitment, len(traps))
+	for t, trap := range traps {
+		comms[t] = Commit(trap)
+	}
+	return comms
+}
+
+// judge decides a round from all its reports. Every member of a group
+// has to report the same counts; whether they add up is for audit to
+// check, group by group.
+func judge(reports []*ReportArgs) (int, string) {
+	totalTraps := make(map[int]int)
+	totalMsgs := make(map[int]int)
+	for _, report := range reports {
+		if !report.CorrectHash {
+			return WITHHOLD, fmt.Sprintf("server %d: messages in the wrong group", report.Sid)
+		}
+		if !report.CorrectTraps {
+			return WITHHOLD, fmt.Sprintf("server %d: missing traps", report.Sid)
+		}
+		if !report.NoDups {
+			return WITHHOLD, fmt.Sprintf("server %d: duplicate messages", report.Sid)
+		}
+		if _, ok := totalTraps[report.Uid]; !ok {
+			totalTraps[report.Uid] = report.NumTraps
+			totalMsgs[report.Uid] = report.NumMsgs
+		}
+		if totalTraps[report.Uid] != report.NumTraps ||
+			totalMsgs[report.Uid] != report.NumMsgs {
+			return WITHHOLD, fmt.Sprintf("group %d: members disagree on the counts", report.Uid)
+		}
+	}
+	return RELEASE, ""
+}
+
+// auditLog appends every verdict to a file, one JSON object per line,
+// before it is given out
+type auditLog struct {
+	lock *sync.Mutex
+	file *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{
+		lock: new(sync.Mutex),
+		file: file,
+	}, nil
+}
+
+func (a *auditLog) append(verdict *Verdict) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	b, err := json.Marshal(verdict)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
+
+// ReadAuditLog reads back the verdicts in a trustee's audit log; their
+// signatures still have to be checked against the trustee's key
+func ReadAuditLog(path string) ([]*Verdict, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var verdicts []*Verdict
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		var verdict Verdict
+		err := json.Unmarshal(scanner.Bytes(), &verdict)
+		if err != nil {
+			return nil, err
+		}
+		verdicts = append(verdicts, &verdict)
+	}
+	return verdicts, scanner.Err()
+}